@@ -0,0 +1,241 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Exit codes.
+const (
+	ExitOK           = 0
+	ExitError        = 1
+	ExitUsage        = 2 // invalid command line or configuration
+	ExitNotConnected = 3 // the container is not connected
+	ExitDegraded     = 4 // status found missing or inconsistent objects
+)
+
+// ErrDegraded is returned by Status when the connection of the container is
+// not in the expected state.
+var ErrDegraded = errors.New("container connection is degraded")
+
+// NotConnectedError reports a container without a local record.
+type NotConnectedError struct {
+	Id string
+}
+
+func (e *NotConnectedError) Error() string {
+	return fmt.Sprintf("container %s is not connected", e.Id)
+}
+
+type UsageError struct {
+	Message string
+}
+
+func (e *UsageError) Error() string {
+	return e.Message
+}
+
+// exitCode returns the exit code for the error of a command.
+func exitCode(err error) int {
+	switch err.(type) {
+	case nil:
+		return ExitOK
+	case *UsageError:
+		return ExitUsage
+	case *NotConnectedError:
+		return ExitNotConnected
+	}
+	if err == ErrDegraded {
+		return ExitDegraded
+	}
+	return ExitError
+}
+
+// CommandOptions are the flags that only apply to some of the commands.
+type CommandOptions struct {
+	Apply    bool
+	Interval time.Duration
+	// Lets gc collect the instances without the packnet marker.
+	CollectUnmarked bool
+	// Allows security-groups to remove all the groups of a container.
+	ClearSecurityGroups bool
+	Sources             ConfigSources
+}
+
+type command struct {
+	name    string
+	args    string // synopsis of the arguments
+	summary string
+	minArgs int
+	maxArgs int
+	run     func(c *Config, opts *CommandOptions, args []string) error
+}
+
+// containerId validates a container id argument and truncates it to the
+// 10 characters used for naming.
+func containerId(id string) (string, error) {
+	if len(id) < 10 {
+		return "", &UsageError{fmt.Sprintf("invalid container id %q", id)}
+	}
+	return id[0:10], nil
+}
+
+// withContainer adapts a command that takes a container id as argument.
+func withContainer(fn func(c *Config, id string) error) func(*Config, *CommandOptions, []string) error {
+	return func(c *Config, opts *CommandOptions, args []string) error {
+		id, err := containerId(args[0])
+		if err != nil {
+			return err
+		}
+		return fn(c, id)
+	}
+}
+
+var commands = []*command{
+	{"start", "<container-id>", "Connect a container to its networks.", 1, 1,
+		func(c *Config, opts *CommandOptions, args []string) error {
+			id, err := containerId(args[0])
+			if err != nil {
+				return err
+			}
+			c.DockerId = id
+			// Object names use the short id, but containerd only knows
+			// its tasks by the id as given.
+			if c.Netns == "" {
+				c.Netns = args[0]
+			}
+			return Start(c)
+		}},
+	{"stop", "<container-id>", "Disconnect a container and delete its objects.", 1, 1,
+		withContainer(func(c *Config, id string) error {
+			c.DockerId = id
+			return Stop(c)
+		})},
+	{"status", "<container-id>", "Check the objects, vrouter ports and namespace of a container.", 1, 1,
+		withContainer(func(c *Config, id string) error {
+			return Status(c, id, os.Stdout)
+		})},
+	{"list", "", "List the connected containers.", 0, 0,
+		func(c *Config, opts *CommandOptions, args []string) error {
+			return List(c, os.Stdout)
+		}},
+	{"inspect", "<container-id>", "Print the record of a container as JSON.", 1, 1,
+		withContainer(func(c *Config, id string) error {
+			return Inspect(c, id, os.Stdout)
+		})},
+	{"reconcile", "", "Repair the connections of the containers (see --interval).", 0, 0,
+		func(c *Config, opts *CommandOptions, args []string) error {
+			return Reconcile(c, opts.Interval, os.Stdout)
+		}},
+	{"gc", "", "Report, or delete with --apply, the objects of removed containers.", 0, 0,
+		func(c *Config, opts *CommandOptions, args []string) error {
+			return GarbageCollect(c, opts.Apply, opts.CollectUnmarked, os.Stdout)
+		}},
+	{"security-groups", "[<container-id>]", "Define security groups and replace those of a container.", 0, 1,
+		func(c *Config, opts *CommandOptions, args []string) error {
+			if len(args) == 0 {
+				return SecurityGroups(c, "", false)
+			}
+			id, err := containerId(args[0])
+			if err != nil {
+				return err
+			}
+			// The groups may also come from the environment or the
+			// configuration file, which can give an empty list.
+			source := opts.Sources["security-group"]
+			if opts.ClearSecurityGroups {
+				if source == SourceFlag {
+					return &UsageError{"--security-group and --clear-security-groups are exclusive"}
+				}
+				return SecurityGroups(c, id, true)
+			}
+			if source == SourceDefault {
+				return &UsageError{"use --security-group, or --clear-security-groups to remove all groups"}
+			}
+			if len(c.SecurityGroups) == 0 {
+				return &UsageError{fmt.Sprintf("empty security group list from %s; use --clear-security-groups to remove all groups", source)}
+			}
+			return SecurityGroups(c, id, false)
+		}},
+	{"policy", "", "Define network policies and attach them to networks.", 0, 0,
+		func(c *Config, opts *CommandOptions, args []string) error {
+			return Policies(c, os.Stdout)
+		}},
+	{"daemon", "", "Connect and disconnect containers from the Docker events.", 0, 0,
+		func(c *Config, opts *CommandOptions, args []string) error {
+			return Daemon(c)
+		}},
+	{"plugin", "", "Run the Docker network and IPAM plugin.", 0, 0,
+		func(c *Config, opts *CommandOptions, args []string) error {
+			return Plugin(c)
+		}},
+	{"config", "show", "Print the effective configuration and the source of each setting.", 1, 1,
+		func(c *Config, opts *CommandOptions, args []string) error {
+			if args[0] != "show" {
+				return &UsageError{"usage: packnet config show"}
+			}
+			return ShowConfig(flag.CommandLine, opts.Sources, os.Stdout)
+		}},
+}
+
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: packnet [flags] <command> [arguments]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-34s %s\n", cmd.name+" "+cmd.args, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand runs the command named by args[0] and returns the exit code.
+func runCommand(c *Config, opts *CommandOptions, args []string) int {
+	if len(args) == 0 {
+		usage()
+		return ExitUsage
+	}
+	cmd := lookupCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		usage()
+		return ExitUsage
+	}
+	args = args[1:]
+	if len(args) < cmd.minArgs || len(args) > cmd.maxArgs {
+		fmt.Fprintf(os.Stderr, "usage: packnet %s %s\n", cmd.name, cmd.args)
+		return ExitUsage
+	}
+	err := cmd.run(c, opts, args)
+	if err != nil {
+		log.Error("%s: %v", cmd.name, err)
+	}
+	return exitCode(err)
+}
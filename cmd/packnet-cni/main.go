@@ -0,0 +1,309 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// packnet-cni is a CNI plugin that connects the network namespace given by
+// the runtime to an OpenContrail virtual-network.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/op/go-logging"
+
+	"github.com/pedro-r-marques/packnet/pkg/auth"
+	"github.com/pedro-r-marques/packnet/pkg/network"
+	"github.com/pedro-r-marques/packnet/pkg/state"
+	"github.com/pedro-r-marques/packnet/pkg/vrouter"
+)
+
+var log = logging.MustGetLogger("packnet")
+
+// NetConf is the CNI network configuration understood by the plugin.
+type NetConf struct {
+	types.NetConf
+	ApiServer     string `json:"api_server"`
+	ApiPort       int    `json:"api_port"`
+	Domain        string `json:"domain"`
+	Tenant        string `json:"tenant"`
+	Network       string `json:"network"`
+	PrivateSubnet string `json:"private_subnet"`
+	// Networks are created dual-stack when set.
+	PrivateSubnet6 string `json:"private_subnet6"`
+	AgentServer    string `json:"agent_server"`
+	AgentPort      int    `json:"agent_port"`
+	// Address allocator backend and the directory of its state.
+	Allocator string `json:"allocator"`
+	StateDir  string `json:"state_dir"`
+	// TLS settings and Keystone credentials of the API server.
+	auth.TLSConfig
+	Auth auth.Config `json:"auth"`
+}
+
+// networkManager returns the network manager for the configuration.
+func (conf *NetConf) networkManager() (network.NetworkManager, error) {
+	var keystone auth.Authenticator
+	if conf.Auth.Enabled() {
+		var err error
+		keystone, err = auth.NewKeystone(&conf.Auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client, err := auth.NewClient(conf.ApiServer, conf.ApiPort, &conf.TLSConfig, keystone)
+	if err != nil {
+		return nil, err
+	}
+	allocator, err := network.NewAllocator(conf.Allocator, client, conf.subnets(), conf.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	return network.NewNetworkManagerWithAllocator(client, conf.subnets(), allocator), nil
+}
+
+// subnets returns the prefixes of the networks created by the plugin.
+func (conf *NetConf) subnets() string {
+	if conf.PrivateSubnet6 == "" {
+		return conf.PrivateSubnet
+	}
+	return conf.PrivateSubnet + "," + conf.PrivateSubnet6
+}
+
+func init() {
+	// stdout carries the CNI result; logs go to stderr.
+	format := "%{module}[%{pid}]: %{time:2006-01-02T15:04:05Z} [%{shortfile}] %{level:s} - %{message}"
+	logging.SetFormatter(logging.MustStringFormatter(format))
+	logging.SetBackend(logging.NewLogBackend(os.Stderr, "", 0))
+	logging.SetLevel(logging.INFO, "")
+}
+
+func loadNetConf(data []byte) (*NetConf, error) {
+	conf := &NetConf{
+		ApiServer:     "localhost",
+		ApiPort:       8082,
+		PrivateSubnet: "10.40.128.0/17",
+		AgentServer:   "localhost",
+		AgentPort:     vrouter.DefaultAgentPort,
+		Allocator:     network.AllocatorContrail,
+		StateDir:      state.DefaultDir,
+		Domain:        network.DefaultDomain,
+	}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+	if conf.Tenant == "" || conf.Network == "" {
+		return nil, fmt.Errorf("network configuration must specify tenant and network")
+	}
+	network.SetDomain(conf.Domain)
+	return conf, nil
+}
+
+func instanceName(args *skel.CmdArgs) (string, error) {
+	if len(args.ContainerID) < 10 {
+		return "", fmt.Errorf("invalid container id %q", args.ContainerID)
+	}
+	return args.ContainerID[0:10], nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	name, err := instanceName(args)
+	if err != nil {
+		return err
+	}
+
+	tx := network.NewTransaction()
+	manager, err := conf.networkManager()
+	if err != nil {
+		return err
+	}
+	metadata, err := manager.BuildWithTransaction(tx, conf.Tenant, conf.Network, name)
+	if err != nil {
+		return tx.Fail("build", err)
+	}
+
+	nsMan := network.NewNetnsManager()
+	masterName, err := nsMan.CreateInterface(name, args.Netns, &network.InterfaceConfig{
+		Name:         args.IfName,
+		MacAddress:   metadata.MacAddress,
+		IpAddress:    metadata.IpAddress,
+		Gateway:      metadata.Gateway,
+		IpAddress6:   metadata.IpAddress6,
+		Gateway6:     metadata.Gateway6,
+		DefaultRoute: true,
+	})
+	if err != nil {
+		return tx.Fail("create interface", err)
+	}
+	tx.Add("veth "+masterName, func() error {
+		return nsMan.DeleteInterface(name, 0)
+	})
+
+	agent := vrouter.NewPortClient(conf.AgentServer, conf.AgentPort)
+	err = agent.AddPort(&vrouter.Port{
+		Id:          metadata.NicId,
+		InstanceId:  metadata.InstanceId,
+		DisplayName: name,
+		IpAddress:   metadata.IpAddress,
+		Ip6Address:  metadata.IpAddress6,
+		VnId:        metadata.NetworkId,
+		MacAddress:  metadata.MacAddress,
+		SystemName:  masterName,
+		Type:        vrouter.PortTypeVM,
+		RxVlanId:    -1,
+		TxVlanId:    -1,
+	})
+	if err != nil {
+		return tx.Fail("add vrouter port", err)
+	}
+
+	gateway := net.ParseIP(metadata.Gateway)
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{
+			{Name: masterName},
+			{Name: args.IfName, Mac: metadata.MacAddress, Sandbox: args.Netns},
+		},
+		IPs: []*current.IPConfig{
+			{
+				Interface: current.Int(1),
+				Address:   net.IPNet{IP: net.ParseIP(metadata.IpAddress), Mask: net.CIDRMask(32, 32)},
+				Gateway:   gateway,
+			},
+		},
+		Routes: []*types.Route{
+			{Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, GW: gateway},
+		},
+	}
+	if metadata.IpAddress6 != "" {
+		gateway6 := net.ParseIP(metadata.Gateway6)
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Interface: current.Int(1),
+			Address:   net.IPNet{IP: net.ParseIP(metadata.IpAddress6), Mask: net.CIDRMask(128, 128)},
+			Gateway:   gateway6,
+		})
+		result.Routes = append(result.Routes, &types.Route{
+			Dst: net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}, GW: gateway6,
+		})
+	}
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	name, err := instanceName(args)
+	if err != nil {
+		return err
+	}
+
+	manager, err := conf.networkManager()
+	if err != nil {
+		return err
+	}
+	metadata, err := manager.Lookup(conf.Tenant, conf.Network, name)
+	if err != nil {
+		log.Warning("Lookup %s: %v", name, err)
+	}
+
+	// Keep going on failure so that a stuck port or interface does not leak
+	// the Contrail objects; the errors are returned together at the end.
+	var errs []string
+	if metadata != nil && metadata.NicId != "" {
+		agent := vrouter.NewPortClient(conf.AgentServer, conf.AgentPort)
+		err = agent.DeletePort(metadata.NicId)
+		if err != nil && !vrouter.IsNotFound(err) {
+			log.Error("Delete port %s: %v", name, err)
+			errs = append(errs, err.Error())
+		}
+	}
+
+	nsMan := network.NewNetnsManager()
+	if err := nsMan.DeleteInterface(name, 0); err != nil {
+		log.Error("Delete interface %s: %v", network.HostInterfaceName(name, 0), err)
+		errs = append(errs, err.Error())
+	}
+
+	if _, err := manager.Teardown(conf.Tenant, conf.Network, name); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("delete %s: %s", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	name, err := instanceName(args)
+	if err != nil {
+		return err
+	}
+
+	manager, err := conf.networkManager()
+	if err != nil {
+		return err
+	}
+	metadata, err := manager.Lookup(conf.Tenant, conf.Network, name)
+	if err != nil {
+		return fmt.Errorf("instance %s: %v", name, err)
+	}
+
+	nsMan := network.NewNetnsManager()
+	err = nsMan.CheckInterface(name, args.Netns, &network.InterfaceConfig{
+		Name:         args.IfName,
+		MacAddress:   metadata.MacAddress,
+		IpAddress:    metadata.IpAddress,
+		Gateway:      metadata.Gateway,
+		IpAddress6:   metadata.IpAddress6,
+		Gateway6:     metadata.Gateway6,
+		DefaultRoute: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	agent := vrouter.NewPortClient(conf.AgentServer, conf.AgentPort)
+	ports, err := agent.ListPorts()
+	if err != nil {
+		return err
+	}
+	for _, port := range ports {
+		if port.Id == metadata.NicId {
+			return nil
+		}
+	}
+	return fmt.Errorf("vrouter port %s not present", metadata.NicId)
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "packnet OpenContrail CNI plugin")
+}
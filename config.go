@@ -0,0 +1,200 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/pedro-r-marques/packnet/pkg/network"
+)
+
+const (
+	DefaultConfigFile = "/etc/packnet/packnet.yaml"
+	// Environment variables are named after the flags, e.g. PACKNET_API_PORT
+	// for --api-port; PACKNET_CONFIG names the configuration file.
+	envPrefix = "PACKNET_"
+)
+
+// Sources of a configuration value, besides the configuration file, which is
+// recorded by path, and the environment, recorded by variable name.
+const (
+	SourceDefault = "default"
+	SourceFlag    = "flag"
+)
+
+// commandFlags are options of the commands rather than settings; they can
+// only be given on the command line.
+var commandFlags = map[string]bool{
+	"config":                true,
+	"start":                 true,
+	"stop":                  true,
+	"apply":                 true,
+	"collect-unmarked":      true,
+	"interval":              true,
+	"clear-security-groups": true,
+}
+
+// secretFlags are settings whose values config show does not print.
+var secretFlags = map[string]bool{
+	"auth-password": true,
+	"auth-token":    true,
+}
+
+// ConfigSources records where each setting, by flag name, got its value.
+type ConfigSources map[string]string
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// configFile returns the path of the configuration file and whether it was
+// requested explicitly, in which case it must exist.
+func configFile(fs *flag.FlagSet) (string, bool) {
+	if f := fs.Lookup("config"); f != nil && f.Changed {
+		return f.Value.String(), true
+	}
+	if path, ok := os.LookupEnv(envName("config")); ok {
+		return path, true
+	}
+	return DefaultConfigFile, false
+}
+
+// readConfigFile returns the settings of the configuration file, a YAML map
+// from flag names to values. Lists are accepted for settings that take
+// several values.
+func readConfigFile(path string, fs *flag.FlagSet) (map[string][]string, error) {
+	var file map[string]interface{}
+	if err := network.LoadSpec(path, &file); err != nil {
+		return nil, err
+	}
+	settings := make(map[string][]string)
+	for key, value := range file {
+		f := fs.Lookup(key)
+		if f == nil || commandFlags[key] {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		switch v := value.(type) {
+		case []interface{}:
+			if _, ok := f.Value.(flag.SliceValue); !ok {
+				return nil, fmt.Errorf("%s: %s takes a single value", path, key)
+			}
+			values := make([]string, 0, len(v))
+			for _, item := range v {
+				values = append(values, fmt.Sprint(item))
+			}
+			settings[key] = values
+		case map[interface{}]interface{}:
+			return nil, fmt.Errorf("%s: %s is not a single value or a list", path, key)
+		case nil:
+			settings[key] = []string{}
+		default:
+			settings[key] = []string{fmt.Sprint(v)}
+		}
+	}
+	return settings, nil
+}
+
+// setValue sets a setting. Values of list settings replace the default.
+func setValue(f *flag.Flag, values []string) error {
+	if slice, ok := f.Value.(flag.SliceValue); ok {
+		return slice.Replace(values)
+	}
+	if len(values) != 1 {
+		return fmt.Errorf("%s takes a single value", f.Name)
+	}
+	return f.Value.Set(values[0])
+}
+
+// LoadConfig layers the configuration file and the PACKNET_* environment
+// variables between the defaults and the command line: each setting of the
+// parsed fs that was not given as a flag takes the value of its environment
+// variable or else of the configuration file.
+func LoadConfig(fs *flag.FlagSet) (ConfigSources, error) {
+	path, explicit := configFile(fs)
+	file, err := readConfigFile(path, fs)
+	if os.IsNotExist(err) && !explicit {
+		file, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make(ConfigSources)
+	var failed error
+	fs.VisitAll(func(f *flag.Flag) {
+		if commandFlags[f.Name] || failed != nil {
+			return
+		}
+		if f.Changed {
+			sources[f.Name] = SourceFlag
+			return
+		}
+		source := SourceDefault
+		values, ok := file[f.Name]
+		if ok {
+			source = path
+		}
+		if env, set := os.LookupEnv(envName(f.Name)); set {
+			values, ok, source = []string{env}, true, envName(f.Name)
+			if _, slice := f.Value.(flag.SliceValue); slice {
+				values = []string{}
+				if env != "" {
+					values = strings.Split(env, ",")
+				}
+			}
+		}
+		if ok {
+			if err := setValue(f, values); err != nil {
+				failed = fmt.Errorf("%s: %v", source, err)
+				return
+			}
+		}
+		sources[f.Name] = source
+	})
+	return sources, failed
+}
+
+// ShowConfig prints the value of each setting of fs and where it came from.
+func ShowConfig(fs *flag.FlagSet, sources ConfigSources, out io.Writer) error {
+	var names []string
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "SETTING\tVALUE\tSOURCE\n")
+	for _, name := range names {
+		f := fs.Lookup(name)
+		value := f.Value.String()
+		if slice, ok := f.Value.(flag.SliceValue); ok {
+			value = strings.Join(slice.GetSlice(), ",")
+		}
+		if secretFlags[name] && value != "" {
+			value = "********"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, value, sources[name])
+	}
+	return w.Flush()
+}
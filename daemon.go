@@ -0,0 +1,196 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pedro-r-marques/packnet/pkg/docker"
+	"github.com/pedro-r-marques/packnet/pkg/network"
+	"github.com/pedro-r-marques/packnet/pkg/state"
+)
+
+// Container labels that select the tenant and networks of a container. Only
+// containers that carry the tenant or network label are managed by the
+// daemon. The network label is a comma separated list; the default route
+// label names the network that owns the default route. The ip and mac labels
+// are comma separated lists with the syntax of the --ip and --mac flags.
+const (
+	LabelTenant       = "packnet.tenant"
+	LabelNetwork      = "packnet.network"
+	LabelDefaultRoute = "packnet.default-route"
+	LabelIp           = "packnet.ip"
+	LabelMac          = "packnet.mac"
+	// Comma separated list of security groups.
+	LabelSecurityGroup = "packnet.security-group"
+	// Floating-ip-pool and optional floating address.
+	LabelFloatingIpPool = "packnet.floating-ip-pool"
+	LabelFloatingIp     = "packnet.floating-ip"
+)
+
+const daemonRetryInterval = 5 * time.Second
+
+// Daemon watches the docker event stream and connects containers when they
+// start and disconnects them when they die. Containers that are already
+// running when the daemon starts, or while the event stream is down, are
+// connected when they have no local record.
+func Daemon(c *Config) error {
+	client := docker.NewClient(c.DockerSocket)
+	for {
+		if err := connectRunning(c, client); err != nil {
+			log.Warning("Running containers: %v", err)
+		}
+		err := client.Events([]string{"start", "die"}, func(event *docker.Event) {
+			handleEvent(c, client, event)
+		})
+		log.Warning("Docker events: %v", err)
+		time.Sleep(daemonRetryInterval)
+	}
+}
+
+// connectRunning handles the labelled running containers that have no local
+// record as if they had just started.
+func connectRunning(c *Config, client docker.Client) error {
+	containers, err := client.ListContainers()
+	if err != nil {
+		return err
+	}
+	store, err := state.NewStore(c.StateDir)
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		if len(container.Id) < 10 || containerConfig(c, container) == nil {
+			continue
+		}
+		_, err := store.Get(container.Id[0:10])
+		if err == nil {
+			continue
+		} else if err != state.ErrNotFound {
+			log.Error("Read state of %s: %v", container.Id[0:10], err)
+			continue
+		}
+		handleEvent(c, client, &docker.Event{Status: "start", Id: container.Id})
+	}
+	return nil
+}
+
+func handleEvent(c *Config, client docker.Client, event *docker.Event) {
+	var cc *Config
+	container, err := client.InspectContainer(event.Id)
+	if err == nil {
+		cc = containerConfig(c, container)
+	} else if event.Status == "die" {
+		// Containers started with --rm are often gone by the time the
+		// event is handled; stop them based on the local record.
+		log.Warning("Inspect container %s: %v", event.Id, err)
+		cc = storedConfig(c, event.Id)
+	} else {
+		log.Error("Inspect container %s: %v", event.Id, err)
+		return
+	}
+	if cc == nil {
+		return
+	}
+
+	switch event.Status {
+	case "start":
+		log.Info("Connecting container %s to %s:%s", cc.DockerId, cc.Tenant, strings.Join(cc.Networks, ","))
+		err = Start(cc)
+	case "die":
+		log.Info("Disconnecting container %s", cc.DockerId)
+		err = Stop(cc)
+	}
+	if err != nil {
+		log.Error("Container %s %s: %v", cc.DockerId, event.Status, err)
+	}
+}
+
+// containerConfig returns the configuration to use for a container, based on
+// its labels, or nil if the container is not managed by packnet.
+func containerConfig(c *Config, container *docker.Container) *Config {
+	labels := container.Config.Labels
+	tenant, hasTenant := labels[LabelTenant]
+	networkName, hasNetwork := labels[LabelNetwork]
+	if !hasTenant && !hasNetwork {
+		return nil
+	}
+
+	cc := *c
+	if hasTenant {
+		cc.Tenant = tenant
+	}
+	if hasNetwork {
+		cc.Networks = strings.Split(networkName, ",")
+		cc.DefaultRouteNetwork = ""
+	}
+	if defaultRoute, ok := labels[LabelDefaultRoute]; ok {
+		cc.DefaultRouteNetwork = defaultRoute
+	}
+	cc.IpAddresses, cc.MacAddresses = nil, nil
+	if ip, ok := labels[LabelIp]; ok {
+		cc.IpAddresses = strings.Split(ip, ",")
+	}
+	if mac, ok := labels[LabelMac]; ok {
+		cc.MacAddresses = strings.Split(mac, ",")
+	}
+	// Like the addresses, the security groups and floating-ip-pool are
+	// per container and not inherited from the daemon flags.
+	cc.SecurityGroups = nil
+	if groups, ok := labels[LabelSecurityGroup]; ok {
+		cc.SecurityGroups = strings.Split(groups, ",")
+	}
+	cc.FloatingIpPool = labels[LabelFloatingIpPool]
+	cc.FloatingIp = labels[LabelFloatingIp]
+	cc.DockerId = container.Id[0:10]
+	cc.NetnsType = network.NetnsDocker
+	cc.Netns = container.Id
+	return &cc
+}
+
+// storedConfig returns the configuration to stop a container that can no
+// longer be inspected, based on its local record, or nil if packnet has no
+// record of the container.
+func storedConfig(c *Config, id string) *Config {
+	if len(id) < 10 {
+		return nil
+	}
+	store, err := state.NewStore(c.StateDir)
+	if err != nil {
+		log.Error("State store %s: %v", c.StateDir, err)
+		return nil
+	}
+	endpoint, err := store.Get(id[0:10])
+	if err != nil {
+		if err != state.ErrNotFound {
+			log.Error("Read state of %s: %v", id[0:10], err)
+		}
+		return nil
+	}
+
+	cc := *c
+	cc.Tenant = endpoint.Tenant
+	cc.Networks = nil
+	for _, ifc := range endpoint.Interfaces {
+		cc.Networks = append(cc.Networks, ifc.Network)
+	}
+	cc.DockerId = id[0:10]
+	cc.NetnsType = endpoint.NetnsType
+	cc.Netns = endpoint.Netns
+	return &cc
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pedro-r-marques/packnet/pkg/docker"
+	"github.com/pedro-r-marques/packnet/pkg/network"
+	"github.com/pedro-r-marques/packnet/pkg/state"
+	"github.com/pedro-r-marques/packnet/pkg/vrouter"
+)
+
+// GarbageCollect reports the OpenContrail objects and local state records of
+// containers created on this host that are no longer running, and deletes them
+// when apply is set. With unmarked, the objects of the unmarked instances of
+// earlier versions whose container is not running here are collected too.
+func GarbageCollect(c *Config, apply, unmarked bool, out io.Writer) error {
+	store, err := state.NewStore(c.StateDir)
+	if err != nil {
+		return err
+	}
+	endpoints, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	// Only the containers connected by start or the daemon have a local
+	// record. The CNI plugin and the network driver also create instances
+	// on this host but keep no record, so their instances are not
+	// considered.
+	live := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		live[endpoint.Id] = endpointRunning(c, endpoint)
+	}
+	// Running docker containers are live regardless of their record; this
+	// also covers the unmarked instances of earlier versions.
+	client := docker.NewClient(c.DockerSocket)
+	containers, err := client.ListContainers()
+	if err != nil {
+		return fmt.Errorf("unable to list containers: %v", err)
+	}
+	for _, container := range containers {
+		if len(container.Id) >= 10 {
+			live[container.Id[0:10]] = true
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	manager, err := newNetworkManager(c)
+	if err != nil {
+		return err
+	}
+	opts := &network.GCOptions{
+		Apply:       apply,
+		Unmarked:    unmarked,
+		DeletePorts: portDeleter(vrouter.NewPortClient(c.AgentServer, c.AgentPort)),
+	}
+	report, err := manager.CollectGarbage(hostname, live, opts)
+	if report != nil {
+		action := "orphan"
+		if report.Applied {
+			action = "deleted"
+		}
+		for _, instance := range report.Instances {
+			fmt.Fprintf(out, "%s virtual-machine %s:%s:%s %s\n", action,
+				network.Domain(), instance.Tenant, instance.Name, instance.Uuid)
+		}
+		for _, instance := range report.Unattributed {
+			fmt.Fprintf(out, "unattributed virtual-machine %s:%s:%s %s\n",
+				network.Domain(), instance.Tenant, instance.Name, instance.Uuid)
+		}
+		for _, uuid := range report.Addresses {
+			fmt.Fprintf(out, "%s instance-ip %s (%s)\n", action, uuid, network.AddressAllocationNetwork)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range endpoints {
+		if live[endpoint.Id] {
+			continue
+		}
+		if apply {
+			if err := store.Delete(endpoint.Id); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "deleted state %s\n", endpoint.Id)
+		} else {
+			fmt.Fprintf(out, "orphan state %s\n", endpoint.Id)
+		}
+	}
+
+	if !apply {
+		fmt.Fprintln(out, "dry run: use --apply to delete")
+	}
+	return nil
+}
+
+// endpointRunning reports whether the namespace of a recorded endpoint can
+// still be resolved. Endpoints whose namespace type is unknown are considered
+// running, so that they are never collected.
+func endpointRunning(c *Config, endpoint *state.Endpoint) bool {
+	resolver, err := network.NewNamespaceResolver(endpoint.NetnsType, c.DockerSocket, c.ContainerdNs)
+	if err != nil {
+		log.Warning("Endpoint %s: %v", endpoint.Id, err)
+		return true
+	}
+	_, err = resolver.Resolve(endpoint.Netns)
+	return err == nil
+}
+
+// portDeleter returns a function that deletes the vrouter ports of an
+// instance. The ports of the agent are listed on first use.
+func portDeleter(agent vrouter.PortClient) func(network.ManagedInstance) error {
+	var ports []vrouter.Port
+	listed := false
+	return func(instance network.ManagedInstance) error {
+		if !listed {
+			var err error
+			if ports, err = agent.ListPorts(); err != nil {
+				return err
+			}
+			listed = true
+		}
+		for _, port := range ports {
+			if port.InstanceId != instance.Uuid {
+				continue
+			}
+			err := agent.DeletePort(port.Id)
+			if err != nil && !vrouter.IsNotFound(err) {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -17,24 +17,62 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/Juniper/contrail-go-api"
 	"github.com/op/go-logging"
 	flag "github.com/spf13/pflag"
 
+	"github.com/pedro-r-marques/packnet/pkg/auth"
+	"github.com/pedro-r-marques/packnet/pkg/docker"
+	"github.com/pedro-r-marques/packnet/pkg/driver"
 	"github.com/pedro-r-marques/packnet/pkg/network"
+	"github.com/pedro-r-marques/packnet/pkg/state"
+	"github.com/pedro-r-marques/packnet/pkg/vrouter"
 )
 
 var log = logging.MustGetLogger("packnet")
 
 type Config struct {
-	ApiServer     string
-	ApiPort       int
-	Tenant        string
-	NetworkName   string
-	DockerId      string
-	PrivateSubnet string
+	Domain              string
+	ApiServer           string
+	ApiPort             int
+	Tenant              string
+	Networks            []string
+	DefaultRouteNetwork string
+	DockerId            string
+	PrivateSubnet       string
+	PrivateSubnet6      string
+	AgentServer         string
+	AgentPort           int
+	NetnsType           string
+	Netns               string
+	DockerSocket        string
+	ContainerdNs        string
+	StateDir            string
+	Allocator           string
+	// Static addresses, as "<address>" for the first network or
+	// "<network>=<address>".
+	IpAddresses  []string
+	MacAddresses []string
+	// Security groups of the container interfaces, and a file that defines
+	// security groups.
+	SecurityGroups    []string
+	SecurityGroupFile string
+	// File that defines network policies between tenant networks.
+	PolicyFile string
+	// Floating-ip-pool, as domain:project:network:pool, and optional address
+	// of the floating-ip of the container.
+	FloatingIpPool string
+	FloatingIp     string
+	// Keystone credentials and TLS settings of the API server.
+	Auth auth.Config
+	TLS  auth.TLSConfig
 }
 
 func init() {
@@ -47,59 +85,450 @@ func init() {
 func main() {
 
 	config := &Config{
+		Domain:        network.DefaultDomain,
 		ApiServer:     "localhost",
 		ApiPort:       8082,
 		Tenant:        "teemo",
-		NetworkName:   "default",
+		Networks:      []string{"default"},
 		PrivateSubnet: "10.40.128.0/17",
+		AgentServer:   "localhost",
+		AgentPort:     vrouter.DefaultAgentPort,
+		NetnsType:     network.NetnsDocker,
+		DockerSocket:  docker.DefaultSocket,
+		ContainerdNs:  "default",
+		StateDir:      state.DefaultDir,
+		Allocator:     network.AllocatorContrail,
+		TLS:           auth.TLSConfig{Scheme: auth.SchemeHttp},
 	}
 	AddFlags(config, flag.CommandLine)
+	opts := new(CommandOptions)
+	flag.BoolVar(&opts.Apply, "apply", false, "gc: delete the orphans found instead of only reporting them.")
+	flag.BoolVar(&opts.CollectUnmarked, "collect-unmarked", false, "gc: also collect the virtual-machines without the packnet marker whose container is not running on this host.")
+	flag.DurationVar(&opts.Interval, "interval", 0, "reconcile: run periodically with this interval instead of once.")
+	flag.BoolVar(&opts.ClearSecurityGroups, "clear-security-groups", false, "security-groups: remove all the groups of the container.")
+	flag.String("config", DefaultConfigFile, "Configuration file. Settings are flag names; environment variables PACKNET_<FLAG> override the file and flags override both.")
+	start := flag.String("start", "", "Connect the container.")
+	stop := flag.String("stop", "", "Disconnect the container.")
+	flag.CommandLine.MarkDeprecated("start", "use \"packnet start <container-id>\"")
+	flag.CommandLine.MarkDeprecated("stop", "use \"packnet stop <container-id>\"")
+	flag.Usage = usage
 	flag.Parse()
 
-	// Truncate Id to 11 digits for consistency
-	config.DockerId = config.DockerId[0:10]
+	sources, err := LoadConfig(flag.CommandLine)
+	if err != nil {
+		log.Error("%v", err)
+		os.Exit(ExitUsage)
+	}
+	opts.Sources = sources
+	network.SetDomain(config.Domain)
 
-	if flag.Lookup("start").Value.String() != "" {
-		Start(config)
-	} else if flag.Lookup("stop").Value.String() != "" {
-		Stop(config)
+	args := flag.Args()
+	if *start != "" {
+		args = []string{"start", *start}
+	} else if *stop != "" {
+		args = []string{"stop", *stop}
 	}
+	os.Exit(runCommand(config, opts, args))
 }
 
 func AddFlags(c *Config, fs *flag.FlagSet) {
 	fs.StringVar(&c.ApiServer, "server", c.ApiServer, "OpenContrail API server.")
+	fs.IntVar(&c.ApiPort, "api-port", c.ApiPort, "OpenContrail API server port.")
+	fs.StringVar(&c.Domain, "domain", c.Domain, "OpenContrail domain of the tenant projects.")
 	fs.StringVar(&c.Tenant, "tenant", c.Tenant, "Administrative domain.")
-	fs.StringVar(&c.NetworkName, "network", c.NetworkName, "Network identifier")
-	fs.StringVar(&c.DockerId, "start", "", "Provision the network of the container")
-	fs.StringVar(&c.DockerId, "stop", "", "Provision the network of the container")
+	fs.StringSliceVar(&c.Networks, "network", c.Networks, "Network identifier. Repeat, or give a comma separated list, to connect the container to several networks.")
+	fs.StringVar(&c.DefaultRouteNetwork, "default-route-network", c.DefaultRouteNetwork, "Network whose interface owns the default route. Defaults to the first network.")
+	fs.StringVar(&c.PrivateSubnet, "private-subnet", c.PrivateSubnet, "IPv4 prefix of the networks created by packnet and of the address allocator.")
+	fs.StringVar(&c.PrivateSubnet6, "private-subnet6", c.PrivateSubnet6, "IPv6 prefix of the networks created by packnet. Networks are dual-stack when set.")
+	fs.StringVar(&c.AgentServer, "agent-server", c.AgentServer, "vrouter agent address.")
+	fs.IntVar(&c.AgentPort, "agent-port", c.AgentPort, "vrouter agent port IPC interface.")
+	fs.StringVar(&c.NetnsType, "netns-type", c.NetnsType, "How to locate the container network namespace: docker, pid, path or containerd.")
+	fs.StringVar(&c.Netns, "netns", c.Netns, "Network namespace target (container id, pid or path). Defaults to the container id given to start.")
+	fs.StringVar(&c.DockerSocket, "docker-socket", c.DockerSocket, "Docker daemon socket.")
+	fs.StringVar(&c.ContainerdNs, "containerd-namespace", c.ContainerdNs, "containerd namespace of the container.")
+	fs.StringVar(&c.StateDir, "state-dir", c.StateDir, "Directory where the state of provisioned containers is kept.")
+	fs.StringVar(&c.Allocator, "allocator", c.Allocator, "Address allocator: contrail, local (host bitmap) or file (host lease files).")
+	fs.StringSliceVar(&c.IpAddresses, "ip", c.IpAddresses, "Static IPv4 or IPv6 address, as <address> for the first network or <network>=<address>. Repeatable.")
+	fs.StringSliceVar(&c.MacAddresses, "mac", c.MacAddresses, "Static mac address, as <mac> for the first network or <network>=<mac>. Repeatable.")
+	fs.StringSliceVar(&c.SecurityGroups, "security-group", c.SecurityGroups, "Security group of the container interfaces. Repeatable.")
+	fs.StringVar(&c.SecurityGroupFile, "security-group-file", c.SecurityGroupFile, "YAML or JSON file that defines security groups in the tenant project.")
+	fs.StringVar(&c.PolicyFile, "policy-file", c.PolicyFile, "YAML or JSON file that defines network policies between tenant networks.")
+	fs.StringVar(&c.FloatingIpPool, "floating-ip-pool", c.FloatingIpPool, "Floating-ip-pool (domain:project:network:pool) from which the container gets a public address. Created on the network when needed.")
+	fs.StringVar(&c.FloatingIp, "floating-ip", c.FloatingIp, "Floating address to request from --floating-ip-pool.")
+	fs.StringVar(&c.TLS.Scheme, "api-scheme", c.TLS.Scheme, "API server scheme: http or https.")
+	fs.StringVar(&c.TLS.CaCert, "ca-cert", c.TLS.CaCert, "CA certificate that verifies the API server. Defaults to the CA bundle of the host.")
+	fs.StringVar(&c.TLS.ClientCert, "client-cert", c.TLS.ClientCert, "Client certificate presented to the API server.")
+	fs.StringVar(&c.TLS.ClientKey, "client-key", c.TLS.ClientKey, "Key of the client certificate.")
+	fs.BoolVar(&c.TLS.InsecureSkipVerify, "insecure-skip-verify", c.TLS.InsecureSkipVerify, "Do not verify the certificate of the API server.")
+	fs.StringVar(&c.Auth.AuthUrl, "auth-url", c.Auth.AuthUrl, "Keystone endpoint, ending in /v2.0 or /v3. Enables authentication with the API server.")
+	fs.StringVar(&c.Auth.Username, "auth-user", c.Auth.Username, "Keystone username.")
+	fs.StringVar(&c.Auth.Password, "auth-password", c.Auth.Password, "Keystone password.")
+	fs.StringVar(&c.Auth.Tenant, "auth-tenant", c.Auth.Tenant, "Keystone tenant (project) of the token.")
+	fs.StringVar(&c.Auth.Token, "auth-token", c.Auth.Token, "Pre-issued Keystone token. Renewed with the password credentials, when given, once it is rejected.")
+	fs.StringVar(&c.Auth.CaFile, "auth-ca-file", c.Auth.CaFile, "CA bundle that verifies the Keystone server.")
+}
+
+// privateSubnets returns the prefixes of the networks created by packnet, as
+// expected by network.NewNetworkManager.
+func (c *Config) privateSubnets() string {
+	if c.PrivateSubnet6 == "" {
+		return c.PrivateSubnet
+	}
+	return c.PrivateSubnet + "," + c.PrivateSubnet6
+}
+
+// Keystone authenticators by credentials, shared by the API clients of the
+// process so that the daemon and reconcile loops reuse their tokens.
+var (
+	authMutex      sync.Mutex
+	authenticators = make(map[auth.Config]auth.Authenticator)
+)
+
+// newApiClient returns a client of the OpenContrail API server, which
+// authenticates with Keystone when the configuration has credentials.
+func newApiClient(c *Config) (contrail.ApiClient, error) {
+	if !c.Auth.Enabled() {
+		return auth.NewClient(c.ApiServer, c.ApiPort, &c.TLS, nil)
+	}
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	keystone, ok := authenticators[c.Auth]
+	if !ok {
+		var err error
+		keystone, err = auth.NewKeystone(&c.Auth)
+		if err != nil {
+			return nil, err
+		}
+		authenticators[c.Auth] = keystone
+	}
+	return auth.NewClient(c.ApiServer, c.ApiPort, &c.TLS, keystone)
+}
+
+// newNetworkManager returns the network manager for the configuration.
+func newNetworkManager(c *Config) (network.NetworkManager, error) {
+	client, err := newApiClient(c)
+	if err != nil {
+		return nil, err
+	}
+	allocator, err := network.NewAllocator(c.Allocator, client, c.privateSubnets(), c.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	return network.NewNetworkManagerWithAllocator(client, c.privateSubnets(), allocator), nil
+}
+
+// interfaceRequests returns the static configuration requested for each
+// network of the container.
+func interfaceRequests(c *Config) ([]*network.InterfaceRequest, error) {
+	requests := make([]*network.InterfaceRequest, len(c.Networks))
+	for i := range requests {
+		requests[i] = new(network.InterfaceRequest)
+	}
+	// lookup returns the request of the network named in value, if any,
+	// and the value without the network name.
+	lookup := func(value string) (*network.InterfaceRequest, string, error) {
+		index := strings.Index(value, "=")
+		if index < 0 {
+			if len(requests) == 0 {
+				return nil, "", fmt.Errorf("no network specified")
+			}
+			return requests[0], value, nil
+		}
+		for i, networkName := range c.Networks {
+			if networkName == value[:index] {
+				return requests[i], value[index+1:], nil
+			}
+		}
+		return nil, "", fmt.Errorf("%s: %s is not one of the container networks", value, value[:index])
+	}
+
+	for _, value := range c.IpAddresses {
+		req, address, err := lookup(value)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", address)
+		}
+		field := &req.IpAddress
+		if ip.To4() == nil {
+			field = &req.IpAddress6
+		}
+		if *field != "" {
+			return nil, fmt.Errorf("more than one address of the same family for a network: %s, %s", *field, address)
+		}
+		*field = ip.String()
+	}
+	for _, value := range c.MacAddresses {
+		req, address, err := lookup(value)
+		if err != nil {
+			return nil, err
+		}
+		mac, err := net.ParseMAC(address)
+		if err != nil {
+			return nil, err
+		}
+		if req.MacAddress != "" {
+			return nil, fmt.Errorf("more than one mac address for a network: %s, %s", req.MacAddress, address)
+		}
+		req.MacAddress = mac.String()
+	}
+	return requests, nil
 }
 
+// containerInterfaceName returns the name of the index-th interface inside
+// the container.
+func containerInterfaceName(index int) string {
+	return fmt.Sprintf("eth%d", index)
+}
+
+// defaultRouteIndex returns the index of the network that owns the default
+// route.
+func defaultRouteIndex(c *Config) (int, error) {
+	if len(c.Networks) == 0 {
+		return 0, fmt.Errorf("no network specified")
+	}
+	if c.DefaultRouteNetwork == "" {
+		return 0, nil
+	}
+	for i, networkName := range c.Networks {
+		if networkName == c.DefaultRouteNetwork {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("default route network %s is not one of %s", c.DefaultRouteNetwork, strings.Join(c.Networks, ","))
+}
+
+// vrouterPort returns the vrouter port of a container interface.
+func vrouterPort(containerId string, ifc *state.Interface) *vrouter.Port {
+	return &vrouter.Port{
+		Id:          ifc.Metadata.NicId,
+		InstanceId:  ifc.Metadata.InstanceId,
+		DisplayName: containerId,
+		IpAddress:   ifc.Metadata.IpAddress,
+		Ip6Address:  ifc.Metadata.IpAddress6,
+		VnId:        ifc.Metadata.NetworkId,
+		MacAddress:  ifc.Metadata.MacAddress,
+		SystemName:  ifc.VethName,
+		Type:        vrouter.PortTypeVM,
+		RxVlanId:    -1,
+		TxVlanId:    -1,
+	}
+}
+
+// Start connects the container to each of its networks. Provisioning is a
+// transaction: when a step fails, the steps completed so far are undone in
+// reverse order.
 func Start(c *Config) error {
-	manager := network.NewNetworkManager(c.ApiServer, c.ApiPort, c.PrivateSubnet)
-	metadata, err := manager.Build(c.Tenant, c.NetworkName, c.DockerId)
+	routeIndex, err := defaultRouteIndex(c)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	nsMan := network.NewNetnsManager()
-	masterName, err := nsMan.CreateInterface(c.DockerId, metadata.MacAddress, metadata.IpAddress, metadata.Gateway)
+	requests, err := interfaceRequests(c)
+	if err != nil {
+		return err
+	}
+	if c.FloatingIp != "" && c.FloatingIpPool == "" {
+		return fmt.Errorf("--floating-ip requires --floating-ip-pool")
+	}
+	store, err := state.NewStore(c.StateDir)
+	if err != nil {
+		return err
+	}
+	previous, err := store.Get(c.DockerId)
+	if err == nil && previous.Stage == state.StageComplete {
+		return fmt.Errorf("container %s is already connected", c.DockerId)
+	} else if err != nil && err != state.ErrNotFound {
+		return err
+	}
+
+	endpoint := &state.Endpoint{
+		Id:        c.DockerId,
+		Tenant:    c.Tenant,
+		NetnsType: c.NetnsType,
+		Netns:     c.Netns,
+	}
+	if endpoint.Netns == "" {
+		endpoint.Netns = c.DockerId
+	}
+
+	manager, err := newNetworkManager(c)
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(-1)
+		return err
+	}
+	tx := network.NewTransaction()
+	for i, networkName := range c.Networks {
+		metadata, err := manager.BuildInterface(tx, c.Tenant, networkName, c.DockerId, i, requests[i])
+		if err != nil {
+			return tx.Fail("build "+networkName, err)
+		}
+		endpoint.Interfaces = append(endpoint.Interfaces, &state.Interface{
+			Network:      networkName,
+			Name:         containerInterfaceName(i),
+			DefaultRoute: i == routeIndex,
+			Metadata:     *metadata,
+		})
+	}
+	if c.FloatingIpPool != "" {
+		address, err := manager.AssociateFloatingIp(tx, c.Tenant, c.DockerId, routeIndex, c.FloatingIpPool, c.FloatingIp)
+		if err != nil {
+			return tx.Fail("floating-ip", err)
+		}
+		endpoint.Interfaces[routeIndex].FloatingIp = address
+		endpoint.Interfaces[routeIndex].FloatingIpPool = c.FloatingIpPool
+	}
+	var groups []string
+	if len(c.SecurityGroups) > 0 {
+		groups = c.SecurityGroups
 	}
+	if err := applySecurityGroups(c, endpoint, groups); err != nil {
+		return tx.Fail("security groups", err)
+	}
+	endpoint.Stage = state.StageBuilt
+	if err := store.Put(endpoint); err != nil {
+		return tx.Fail("save state", err)
+	}
+	tx.Add("state", func() error {
+		if previous != nil {
+			return store.Put(previous)
+		}
+		return store.Delete(c.DockerId)
+	})
 
-	cmd := exec.Command("vrouter-ctl", "--mac-address", metadata.MacAddress,
-		"--vm", metadata.InstanceId, "--vmi", metadata.NicId,
-		"--interface", masterName, "add", c.DockerId)
-	err = cmd.Run()
+	resolver, err := network.NewNamespaceResolver(c.NetnsType, c.DockerSocket, c.ContainerdNs)
 	if err != nil {
-		out, _ := cmd.CombinedOutput()
-		log.Fatal(err.Error() + ": " + string(out))
+		return tx.Fail("resolve network namespace", err)
+	}
+	nsPath, err := resolver.Resolve(endpoint.Netns)
+	if err != nil {
+		return tx.Fail("resolve network namespace", fmt.Errorf("%s: %v", endpoint.Netns, err))
+	}
+
+	nsMan := network.NewNetnsManager()
+	for i, ifc := range endpoint.Interfaces {
+		index := i
+		masterName, err := nsMan.CreateInterface(c.DockerId, nsPath, ifc.Config(index))
+		if err != nil {
+			return tx.Fail("create interface "+ifc.Name, err)
+		}
+		tx.Add("veth "+masterName, func() error {
+			return nsMan.DeleteInterface(c.DockerId, index)
+		})
+		ifc.VethName = masterName
+	}
+	endpoint.Stage = state.StageInterface
+	if err := store.Put(endpoint); err != nil {
+		return tx.Fail("save state", err)
+	}
+
+	agent := vrouter.NewPortClient(c.AgentServer, c.AgentPort)
+	for _, ifc := range endpoint.Interfaces {
+		nicId := ifc.Metadata.NicId
+		if err := agent.AddPort(vrouterPort(c.DockerId, ifc)); err != nil {
+			return tx.Fail("add vrouter port "+nicId, err)
+		}
+		tx.Add("vrouter port "+nicId, func() error {
+			return agent.DeletePort(nicId)
+		})
+	}
+
+	endpoint.Stage = state.StageComplete
+	if err := store.Put(endpoint); err != nil {
+		return tx.Fail("save state", err)
 	}
 	return nil
 }
 
+// Stop disconnects the container from all of its networks and releases its
+// floating-ips. Without a local record, the interfaces are looked up for the
+// networks in the configuration.
 func Stop(c *Config) error {
+	store, err := state.NewStore(c.StateDir)
+	if err != nil {
+		return err
+	}
+	tenant := c.Tenant
+
+	manager, err := newNetworkManager(c)
+	if err != nil {
+		return err
+	}
+	var interfaces []*state.Interface
+	endpoint, err := store.Get(c.DockerId)
+	if err == nil {
+		tenant = endpoint.Tenant
+		interfaces = endpoint.Interfaces
+	} else if err == state.ErrNotFound {
+		for i, networkName := range c.Networks {
+			ifc := &state.Interface{Network: networkName}
+			metadata, err := manager.LookupInterface(tenant, networkName, c.DockerId, i)
+			if err != nil {
+				log.Warning("Lookup %s: %v", network.InterfaceName(c.DockerId, i), err)
+			}
+			if metadata != nil {
+				ifc.Metadata = *metadata
+			}
+			interfaces = append(interfaces, ifc)
+		}
+	} else {
+		return err
+	}
+
+	// Keep going on failure so that a missing or stuck piece does not leak
+	// the others; the errors are returned together at the end.
+	var errs []string
+	agent := vrouter.NewPortClient(c.AgentServer, c.AgentPort)
 	nsMan := network.NewNetnsManager()
-	nsMan.DeleteInterface(c.DockerId)
-	return nil
+	for i, ifc := range interfaces {
+		if nicId := ifc.Metadata.NicId; nicId != "" {
+			err = agent.DeletePort(nicId)
+			if err != nil && !vrouter.IsNotFound(err) {
+				log.Error("Delete port %s: %v", nicId, err)
+				errs = append(errs, err.Error())
+			}
+		}
+
+		err = nsMan.DeleteInterface(c.DockerId, i)
+		if err != nil {
+			log.Error("Delete interface %s: %v", network.HostInterfaceName(c.DockerId, i), err)
+			errs = append(errs, err.Error())
+		}
+	}
+
+	report, err := manager.Teardown(tenant, "", c.DockerId)
+	if err != nil {
+		log.Error("Teardown %s: %v (%s)", c.DockerId, err, report)
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("stop %s: %s", c.DockerId, strings.Join(errs, "; "))
+	}
+	return store.Delete(c.DockerId)
+}
+
+// Plugin runs the libnetwork remote network and IPAM driver.
+func Plugin(c *Config) error {
+	client, err := newApiClient(c)
+	if err != nil {
+		return err
+	}
+	agent := vrouter.NewPortClient(c.AgentServer, c.AgentPort)
+	stateFile := filepath.Join(c.StateDir, driver.StateFile)
+	if len(c.Networks) == 0 {
+		return fmt.Errorf("no network specified")
+	}
+	// The driver only hands out IPv4 pools and addresses to libnetwork.
+	if c.PrivateSubnet6 != "" {
+		return fmt.Errorf("--private-subnet6 is not supported by the network plugin")
+	}
+	allocator, err := network.NewAllocator(c.Allocator, client, c.PrivateSubnet, c.StateDir)
+	if err != nil {
+		return err
+	}
+	d, err := driver.NewDriver(client, allocator, agent, c.PrivateSubnet, c.Tenant, c.Networks[0], stateFile)
+	if err != nil {
+		return err
+	}
+	return d.Serve(driver.DefaultSocket)
 }
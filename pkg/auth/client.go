@@ -0,0 +1,150 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"strings"
+
+	"github.com/Juniper/contrail-go-api"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("packnet")
+
+// isUnauthorized reports whether err is the API server response for a
+// request with a missing, invalid or expired token. The client returns these
+// as "<status code> <reason>: <body>".
+func isUnauthorized(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "401 ")
+}
+
+// ClientImpl is an OpenContrail API client that authenticates its requests
+// and, when the API server rejects the token, retries them once with a new
+// token.
+type ClientImpl struct {
+	client contrail.ApiClient
+	auth   Authenticator
+}
+
+// NewClient returns an API client of server:port, secured as set by tls, that
+// authenticates with auth when not nil.
+func NewClient(server string, port int, tls *TLSConfig, auth Authenticator) (contrail.ApiClient, error) {
+	client := contrail.NewClient(server, port)
+	if err := tls.Apply(client); err != nil {
+		return nil, err
+	}
+	if auth == nil {
+		return client, nil
+	}
+	client.SetAuthenticator(auth)
+	return NewClientWithAuthenticator(client, auth), nil
+}
+
+// NewClientWithAuthenticator wraps client, which must already use auth, so
+// that requests rejected with 401 are retried with a new token.
+func NewClientWithAuthenticator(client contrail.ApiClient, auth Authenticator) contrail.ApiClient {
+	return &ClientImpl{client: client, auth: auth}
+}
+
+func (c *ClientImpl) retry(fn func() error) error {
+	err := fn()
+	if isUnauthorized(err) && c.auth.Invalidate() {
+		log.Info("API server rejected the token, authenticating again")
+		err = fn()
+	}
+	return err
+}
+
+func (c *ClientImpl) Create(ptr contrail.IObject) error {
+	return c.retry(func() error { return c.client.Create(ptr) })
+}
+
+func (c *ClientImpl) Update(ptr contrail.IObject) error {
+	return c.retry(func() error { return c.client.Update(ptr) })
+}
+
+func (c *ClientImpl) DeleteByUuid(typename, uuid string) error {
+	return c.retry(func() error { return c.client.DeleteByUuid(typename, uuid) })
+}
+
+func (c *ClientImpl) Delete(ptr contrail.IObject) error {
+	return c.retry(func() error { return c.client.Delete(ptr) })
+}
+
+func (c *ClientImpl) FindByUuid(typename string, uuid string) (obj contrail.IObject, err error) {
+	err = c.retry(func() error {
+		obj, err = c.client.FindByUuid(typename, uuid)
+		return err
+	})
+	return obj, err
+}
+
+func (c *ClientImpl) UuidByName(typename string, fqn string) (uuid string, err error) {
+	err = c.retry(func() error {
+		uuid, err = c.client.UuidByName(typename, fqn)
+		return err
+	})
+	return uuid, err
+}
+
+func (c *ClientImpl) FQNameByUuid(uuid string) (fqn []string, err error) {
+	err = c.retry(func() error {
+		fqn, err = c.client.FQNameByUuid(uuid)
+		return err
+	})
+	return fqn, err
+}
+
+func (c *ClientImpl) FindByName(typename string, fqn string) (obj contrail.IObject, err error) {
+	err = c.retry(func() error {
+		obj, err = c.client.FindByName(typename, fqn)
+		return err
+	})
+	return obj, err
+}
+
+func (c *ClientImpl) List(typename string) (list []contrail.ListResult, err error) {
+	err = c.retry(func() error {
+		list, err = c.client.List(typename)
+		return err
+	})
+	return list, err
+}
+
+func (c *ClientImpl) ListByParent(typename string, parentID string) (list []contrail.ListResult, err error) {
+	err = c.retry(func() error {
+		list, err = c.client.ListByParent(typename, parentID)
+		return err
+	})
+	return list, err
+}
+
+func (c *ClientImpl) ListDetail(typename string, fields []string) (list []contrail.IObject, err error) {
+	err = c.retry(func() error {
+		list, err = c.client.ListDetail(typename, fields)
+		return err
+	})
+	return list, err
+}
+
+func (c *ClientImpl) ListDetailByParent(typename string, parentID string, fields []string) (list []contrail.IObject, err error) {
+	err = c.retry(func() error {
+		list, err = c.client.ListDetailByParent(typename, parentID, fields)
+		return err
+	})
+	return list, err
+}
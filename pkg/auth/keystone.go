@@ -0,0 +1,251 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package auth secures the connection of the OpenContrail API client with TLS
+// and authenticates its requests with Keystone tokens.
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Juniper/contrail-go-api"
+)
+
+// Tokens are renewed this long before they expire.
+const tokenRenewMargin = time.Minute
+
+// Config holds the Keystone credentials. Token is a pre-issued token; when
+// Password is also given, a new token is requested once Token is rejected.
+type Config struct {
+	AuthUrl  string `json:"url"` // Keystone endpoint, ending in /v2.0 or /v3
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Tenant   string `json:"tenant"`
+	Token    string `json:"token"`
+	CaFile   string `json:"ca_file"` // CA bundle that verifies the Keystone server
+}
+
+// Enabled reports whether the configuration requests authentication.
+func (c *Config) Enabled() bool {
+	return c.AuthUrl != "" || c.Token != ""
+}
+
+type Authenticator interface {
+	contrail.Authenticator
+	// Invalidate discards the current token after the API server rejected
+	// it. It reports whether a new token can be obtained.
+	Invalidate() bool
+}
+
+type KeystoneImpl struct {
+	config  Config
+	client  *http.Client
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func NewKeystone(config *Config) (Authenticator, error) {
+	if config.Token == "" && (config.AuthUrl == "" || config.Username == "") {
+		return nil, fmt.Errorf("keystone authentication requires a token or an auth url and a username")
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if config.CaFile != "" {
+		pem, err := ioutil.ReadFile(config.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", config.CaFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &KeystoneImpl{
+		config: *config,
+		client: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		token:  config.Token,
+	}, nil
+}
+
+func (k *KeystoneImpl) canAuthenticate() bool {
+	return k.config.AuthUrl != "" && k.config.Username != ""
+}
+
+// AddAuthentication sets the token header of an API request, requesting a
+// new token when there is none or when it is about to expire.
+func (k *KeystoneImpl) AddAuthentication(req *http.Request) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	renew := !k.expires.IsZero() && time.Now().Add(tokenRenewMargin).After(k.expires)
+	if (k.token == "" || renew) && k.canAuthenticate() {
+		if err := k.authenticate(); err != nil {
+			return err
+		}
+	}
+	if k.token == "" {
+		return fmt.Errorf("no keystone token available")
+	}
+	req.Header.Set("X-Auth-Token", k.token)
+	return nil
+}
+
+func (k *KeystoneImpl) Invalidate() bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if !k.canAuthenticate() {
+		return false
+	}
+	k.token = ""
+	k.expires = time.Time{}
+	return true
+}
+
+// authenticate requests a token with the password credentials, using the
+// identity API version of the auth url.
+func (k *KeystoneImpl) authenticate() error {
+	url := strings.TrimRight(k.config.AuthUrl, "/")
+	var err error
+	if strings.HasSuffix(url, "/v3") {
+		err = k.authenticateV3(url)
+	} else {
+		err = k.authenticateV2(url)
+	}
+	if err != nil {
+		return fmt.Errorf("keystone %s: %v", k.config.AuthUrl, err)
+	}
+	log.Debug("Keystone token for %s@%s expires at %v", k.config.Username, k.config.Tenant, k.expires)
+	return nil
+}
+
+func (k *KeystoneImpl) post(url string, request interface{}) (*http.Response, []byte, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := k.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, body, nil
+}
+
+func (k *KeystoneImpl) authenticateV2(url string) error {
+	type passwordCredentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	var request struct {
+		Auth struct {
+			TenantName          string              `json:"tenantName"`
+			PasswordCredentials passwordCredentials `json:"passwordCredentials"`
+		} `json:"auth"`
+	}
+	request.Auth.TenantName = k.config.Tenant
+	request.Auth.PasswordCredentials = passwordCredentials{k.config.Username, k.config.Password}
+
+	_, body, err := k.post(url+"/tokens", &request)
+	if err != nil {
+		return err
+	}
+	var response struct {
+		Access struct {
+			Token struct {
+				Id      string    `json:"id"`
+				Expires time.Time `json:"expires"`
+			} `json:"token"`
+		} `json:"access"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return err
+	}
+	if response.Access.Token.Id == "" {
+		return fmt.Errorf("no token in response")
+	}
+	k.token = response.Access.Token.Id
+	k.expires = response.Access.Token.Expires
+	return nil
+}
+
+func (k *KeystoneImpl) authenticateV3(url string) error {
+	type domain struct {
+		Id string `json:"id"`
+	}
+	var request struct {
+		Auth struct {
+			Identity struct {
+				Methods  []string `json:"methods"`
+				Password struct {
+					User struct {
+						Name     string `json:"name"`
+						Domain   domain `json:"domain"`
+						Password string `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+			Scope struct {
+				Project struct {
+					Name   string `json:"name"`
+					Domain domain `json:"domain"`
+				} `json:"project"`
+			} `json:"scope"`
+		} `json:"auth"`
+	}
+	request.Auth.Identity.Methods = []string{"password"}
+	user := &request.Auth.Identity.Password.User
+	user.Name = k.config.Username
+	user.Domain.Id = "default"
+	user.Password = k.config.Password
+	request.Auth.Scope.Project.Name = k.config.Tenant
+	request.Auth.Scope.Project.Domain.Id = "default"
+
+	resp, body, err := k.post(url+"/auth/tokens", &request)
+	if err != nil {
+		return err
+	}
+	var response struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+		} `json:"token"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return err
+	}
+	token := resp.Header.Get("X-Subject-Token")
+	if token == "" {
+		return fmt.Errorf("no token in response")
+	}
+	k.token = token
+	k.expires = response.Token.ExpiresAt
+	return nil
+}
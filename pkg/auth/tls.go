@@ -0,0 +1,95 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Juniper/contrail-go-api"
+)
+
+const (
+	SchemeHttp  = "http"
+	SchemeHttps = "https"
+)
+
+// TLSConfig selects how the connection to the API server is secured.
+type TLSConfig struct {
+	Scheme string `json:"api_scheme"` // http (default) or https
+	// CA certificate that verifies the API server, and the optional client
+	// certificate and key for mutual TLS.
+	CaCert             string `json:"ca_cert"`
+	ClientCert         string `json:"client_cert"`
+	ClientKey          string `json:"client_key"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// Apply configures client to reach the API server over TLS when the scheme
+// is https.
+func (t *TLSConfig) Apply(client *contrail.Client) error {
+	switch t.Scheme {
+	case "", SchemeHttp:
+		if t.CaCert != "" || t.ClientCert != "" || t.ClientKey != "" || t.InsecureSkipVerify {
+			return fmt.Errorf("TLS options require the %s scheme", SchemeHttps)
+		}
+		return nil
+	case SchemeHttps:
+	default:
+		return fmt.Errorf("invalid API scheme %q", t.Scheme)
+	}
+
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return fmt.Errorf("a client certificate requires a client key and vice versa")
+	}
+	caCert := t.CaCert
+	if caCert == "" && !t.InsecureSkipVerify {
+		var err error
+		if caCert, err = systemCAFile(); err != nil {
+			return err
+		}
+	}
+	if t.InsecureSkipVerify {
+		log.Warning("The certificate of the API server is not verified")
+	}
+	return client.AddEncryption(caCert, t.ClientKey, t.ClientCert, t.InsecureSkipVerify)
+}
+
+// Locations of the system CA bundle, as searched by crypto/x509.
+var systemCAFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// systemCAFile returns the CA bundle of the host, which verifies the API
+// server when no CA certificate is given. The client only takes the CA
+// certificates as a file.
+func systemCAFile() (string, error) {
+	if path := os.Getenv("SSL_CERT_FILE"); path != "" {
+		return path, nil
+	}
+	for _, path := range systemCAFiles {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no system CA bundle found; use a CA certificate to verify the API server")
+}
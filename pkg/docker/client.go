@@ -0,0 +1,163 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+const (
+	DefaultSocket = "/var/run/docker.sock"
+)
+
+type Event struct {
+	Status string `json:"status"`
+	Id     string `json:"id"`
+	From   string `json:"from"`
+	Time   int64  `json:"time"`
+}
+
+type ContainerState struct {
+	Running bool
+	Pid     int
+}
+
+type ContainerConfig struct {
+	Labels map[string]string
+}
+
+type Container struct {
+	Id     string
+	Name   string
+	State  ContainerState
+	Config ContainerConfig
+}
+
+// Client is a minimal client for the Docker remote API, served over the
+// daemon unix socket.
+type Client interface {
+	// Events blocks reading the event stream and calls handler for each
+	// event whose status is in the filter list.
+	Events(filter []string, handler func(*Event)) error
+	InspectContainer(id string) (*Container, error)
+	// ListContainers returns the running containers. Only the Id and the
+	// labels are filled in.
+	ListContainers() ([]*Container, error)
+}
+
+type ClientImpl struct {
+	client *http.Client
+}
+
+func NewClient(socket string) Client {
+	transport := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}
+	c := &ClientImpl{
+		client: &http.Client{Transport: transport},
+	}
+	return c
+}
+
+func (c *ClientImpl) get(path string) (*http.Response, error) {
+	resp, err := c.client.Get("http://docker" + path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, string(body))
+	}
+	return resp, nil
+}
+
+func (c *ClientImpl) Events(filter []string, handler func(*Event)) error {
+	path := "/events"
+	if len(filter) > 0 {
+		data, err := json.Marshal(map[string][]string{"event": filter})
+		if err != nil {
+			return err
+		}
+		path += "?filters=" + url.QueryEscape(string(data))
+	}
+	resp, err := c.get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := new(Event)
+		if err := decoder.Decode(event); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("event stream closed")
+			}
+			return err
+		}
+		handler(event)
+	}
+}
+
+func (c *ClientImpl) InspectContainer(id string) (*Container, error) {
+	resp, err := c.get("/containers/" + id + "/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	container := new(Container)
+	if err := json.NewDecoder(resp.Body).Decode(container); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+type containerSummary struct {
+	Id     string
+	Labels map[string]string
+}
+
+func (c *ClientImpl) ListContainers() ([]*Container, error) {
+	resp, err := c.get("/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var summaries []containerSummary
+	if err := json.NewDecoder(resp.Body).Decode(&summaries); err != nil {
+		return nil, err
+	}
+	containers := make([]*Container, 0, len(summaries))
+	for _, summary := range summaries {
+		container := &Container{Id: summary.Id}
+		container.State.Running = true
+		container.Config.Labels = summary.Labels
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
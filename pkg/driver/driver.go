@@ -0,0 +1,500 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package driver implements the libnetwork remote network driver and IPAM
+// driver plugin protocols on top of the packnet network package.
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Juniper/contrail-go-api"
+	"github.com/op/go-logging"
+
+	"github.com/pedro-r-marques/packnet/pkg/network"
+	"github.com/pedro-r-marques/packnet/pkg/vrouter"
+)
+
+var log = logging.MustGetLogger("packnet")
+
+const (
+	DefaultSocket = "/run/docker/plugins/packnet.sock"
+	StateFile     = "driver.json"
+
+	contentType = "application/vnd.docker.plugins.v1+json"
+
+	// Generic network options: docker network create -o tenant=... -o network=...
+	optionGeneric = "com.docker.network.generic"
+	optionTenant  = "tenant"
+	optionNetwork = "network"
+)
+
+type networkInfo struct {
+	Tenant string
+	Name   string
+}
+
+// driverState is the part of the driver state that must survive a restart:
+// docker does not replay CreateNetwork or RequestAddress.
+type driverState struct {
+	Networks map[string]*networkInfo
+	// Address to allocator key.
+	Addresses map[string]string
+}
+
+type Driver struct {
+	networks      network.NetworkManager
+	instances     network.InstanceManager
+	allocator     network.AddressAllocator
+	netns         network.NetnsManager
+	agent         vrouter.PortClient
+	privateSubnet string
+	tenant        string
+	networkName   string
+	stateFile     string
+
+	mutex sync.Mutex
+	state driverState
+}
+
+// NewDriver returns a driver that assigns addresses from privateSubnet with
+// the given allocator.
+func NewDriver(client contrail.ApiClient, allocator network.AddressAllocator, agent vrouter.PortClient,
+	privateSubnet, tenant, networkName, stateFile string) (*Driver, error) {
+	d := &Driver{
+		networks:      network.NewNetworkManagerWithAllocator(client, privateSubnet, allocator),
+		allocator:     allocator,
+		netns:         network.NewNetnsManager(),
+		agent:         agent,
+		privateSubnet: privateSubnet,
+		tenant:        tenant,
+		networkName:   networkName,
+		stateFile:     stateFile,
+		state: driverState{
+			Networks:  make(map[string]*networkInfo),
+			Addresses: make(map[string]string),
+		},
+	}
+	d.instances = network.NewInstanceManager(client, d.allocator)
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Driver) load() error {
+	data, err := ioutil.ReadFile(d.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &d.state)
+}
+
+// save must be called with the mutex held.
+func (d *Driver) save() error {
+	data, err := json.Marshal(&d.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.stateFile), 0755); err != nil {
+		return err
+	}
+	tmpFile := d.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, d.stateFile)
+}
+
+// Serve listens on the plugin unix socket and handles requests until an
+// error occurs.
+func (d *Driver) Serve(socket string) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return err
+	}
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	mux := http.NewServeMux()
+	handle(mux, "Plugin.Activate", d.activate)
+	handle(mux, "NetworkDriver.GetCapabilities", d.getCapabilities)
+	handle(mux, "NetworkDriver.CreateNetwork", d.createNetwork)
+	handle(mux, "NetworkDriver.DeleteNetwork", d.deleteNetwork)
+	handle(mux, "NetworkDriver.CreateEndpoint", d.createEndpoint)
+	handle(mux, "NetworkDriver.DeleteEndpoint", d.deleteEndpoint)
+	handle(mux, "NetworkDriver.EndpointOperInfo", d.endpointOperInfo)
+	handle(mux, "NetworkDriver.Join", d.join)
+	handle(mux, "NetworkDriver.Leave", d.leave)
+	handle(mux, "NetworkDriver.DiscoverNew", d.empty)
+	handle(mux, "NetworkDriver.DiscoverDelete", d.empty)
+	handle(mux, "NetworkDriver.ProgramExternalConnectivity", d.empty)
+	handle(mux, "NetworkDriver.RevokeExternalConnectivity", d.empty)
+	handle(mux, "IpamDriver.GetCapabilities", d.ipamGetCapabilities)
+	handle(mux, "IpamDriver.GetDefaultAddressSpaces", d.getDefaultAddressSpaces)
+	handle(mux, "IpamDriver.RequestPool", d.requestPool)
+	handle(mux, "IpamDriver.ReleasePool", d.empty)
+	handle(mux, "IpamDriver.RequestAddress", d.requestAddress)
+	handle(mux, "IpamDriver.ReleaseAddress", d.releaseAddress)
+
+	log.Info("Listening on %s", socket)
+	return http.Serve(listener, mux)
+}
+
+type errorResponse struct {
+	Err string
+}
+
+func handle(mux *http.ServeMux, method string, fn func(body []byte) (interface{}, error)) {
+	mux.HandleFunc("/"+method, func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		var response interface{}
+		if err == nil {
+			log.Debug("%s: %s", method, string(body))
+			response, err = fn(body)
+		}
+		w.Header().Set("Content-Type", contentType)
+		if err != nil {
+			log.Error("%s: %v", method, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			response = &errorResponse{Err: err.Error()}
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+func decode(body []byte, request interface{}) error {
+	if len(body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, request)
+}
+
+func (d *Driver) activate(body []byte) (interface{}, error) {
+	return map[string][]string{"Implements": {"NetworkDriver", "IpamDriver"}}, nil
+}
+
+func (d *Driver) empty(body []byte) (interface{}, error) {
+	return map[string]string{}, nil
+}
+
+func (d *Driver) getCapabilities(body []byte) (interface{}, error) {
+	return map[string]string{"Scope": "local"}, nil
+}
+
+type createNetworkRequest struct {
+	NetworkID string
+	Options   map[string]interface{}
+}
+
+type networkRequest struct {
+	NetworkID string
+}
+
+func (d *Driver) createNetwork(body []byte) (interface{}, error) {
+	var request createNetworkRequest
+	if err := decode(body, &request); err != nil {
+		return nil, err
+	}
+
+	info := &networkInfo{Tenant: d.tenant, Name: d.networkName}
+	if generic, ok := request.Options[optionGeneric].(map[string]interface{}); ok {
+		if tenant, ok := generic[optionTenant].(string); ok {
+			info.Tenant = tenant
+		}
+		if name, ok := generic[optionNetwork].(string); ok {
+			info.Name = name
+		}
+	}
+
+	if _, err := d.networks.LocateNetwork(info.Tenant, info.Name); err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.state.Networks[request.NetworkID] = info
+	return map[string]string{}, d.save()
+}
+
+func (d *Driver) deleteNetwork(body []byte) (interface{}, error) {
+	var request networkRequest
+	if err := decode(body, &request); err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.state.Networks, request.NetworkID)
+	return map[string]string{}, d.save()
+}
+
+func (d *Driver) lookupNetwork(networkId string) (*networkInfo, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	info, ok := d.state.Networks[networkId]
+	if !ok {
+		return nil, fmt.Errorf("network %s not found", networkId)
+	}
+	return info, nil
+}
+
+// instanceName returns the name of the virtual-machine of an endpoint.
+func instanceName(endpointId string) (string, error) {
+	if len(endpointId) < 10 {
+		return "", fmt.Errorf("invalid endpoint id %q", endpointId)
+	}
+	return endpointId[0:10], nil
+}
+
+type endpointInterface struct {
+	Address     string `json:",omitempty"`
+	AddressIPv6 string `json:",omitempty"`
+	MacAddress  string `json:",omitempty"`
+}
+
+type createEndpointRequest struct {
+	NetworkID  string
+	EndpointID string
+	Interface  *endpointInterface
+}
+
+type createEndpointResponse struct {
+	Interface *endpointInterface `json:",omitempty"`
+}
+
+type endpointRequest struct {
+	NetworkID  string
+	EndpointID string
+}
+
+func (d *Driver) createEndpoint(body []byte) (interface{}, error) {
+	var request createEndpointRequest
+	if err := decode(body, &request); err != nil {
+		return nil, err
+	}
+	info, err := d.lookupNetwork(request.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	if request.Interface == nil {
+		request.Interface = new(endpointInterface)
+	}
+	if request.Interface.MacAddress != "" {
+		return nil, fmt.Errorf("mac address assignment is not supported")
+	}
+	name, err := instanceName(request.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	address := ""
+	if request.Interface.Address != "" {
+		ip, _, err := net.ParseCIDR(request.Interface.Address)
+		if err != nil {
+			return nil, err
+		}
+		address = ip.String()
+	}
+
+	vn, err := d.networks.LocateNetwork(info.Tenant, info.Name)
+	if err != nil {
+		return nil, err
+	}
+	tx := network.NewTransaction()
+	instance, err := d.instances.LocateInstance(info.Tenant, name)
+	if err != nil {
+		return nil, err
+	}
+	// The endpoint id is unique, so everything created for it from here on
+	// is removed when a later step fails.
+	tx.Add("instance "+name, func() error {
+		_, err := d.networks.Teardown(info.Tenant, info.Name, name)
+		return err
+	})
+	nic, err := d.instances.LocateInterface(vn, instance)
+	if err != nil {
+		return nil, tx.Fail("interface", err)
+	}
+	instanceIp, err := d.instances.LocateInstanceIpWithAddress(vn, nic, network.FamilyV4, address)
+	if err != nil {
+		return nil, tx.Fail("instance-ip", err)
+	}
+
+	macs := nic.GetVirtualMachineInterfaceMacAddresses()
+	if len(macs.MacAddress) == 0 {
+		return nil, tx.Fail("mac address", fmt.Errorf("interface %s has no mac address", nic.GetUuid()))
+	}
+
+	response := &createEndpointResponse{
+		Interface: &endpointInterface{MacAddress: macs.MacAddress[0]},
+	}
+	if address == "" {
+		prefix, err := d.instances.LocateInstanceSubnet(vn, network.FamilyV4)
+		if err != nil {
+			return nil, tx.Fail("address", err)
+		}
+		_, subnet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, tx.Fail("address", err)
+		}
+		prefixLen, _ := subnet.Mask.Size()
+		response.Interface.Address = fmt.Sprintf("%s/%d", instanceIp.GetInstanceIpAddress(), prefixLen)
+	}
+	return response, nil
+}
+
+func (d *Driver) deleteEndpoint(body []byte) (interface{}, error) {
+	var request endpointRequest
+	if err := decode(body, &request); err != nil {
+		return nil, err
+	}
+	info, err := d.lookupNetwork(request.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	name, err := instanceName(request.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.networks.Teardown(info.Tenant, info.Name, name)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{}, nil
+}
+
+func (d *Driver) endpointOperInfo(body []byte) (interface{}, error) {
+	return map[string]interface{}{"Value": map[string]string{}}, nil
+}
+
+type joinRequest struct {
+	NetworkID  string
+	EndpointID string
+	SandboxKey string
+}
+
+type interfaceName struct {
+	SrcName   string
+	DstPrefix string
+}
+
+type joinResponse struct {
+	InterfaceName interfaceName
+	Gateway       string
+}
+
+func (d *Driver) join(body []byte) (interface{}, error) {
+	var request joinRequest
+	if err := decode(body, &request); err != nil {
+		return nil, err
+	}
+	info, err := d.lookupNetwork(request.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	name, err := instanceName(request.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+
+	vn, err := d.networks.LocateNetwork(info.Tenant, info.Name)
+	if err != nil {
+		return nil, err
+	}
+	gateway, err := d.instances.LocateInstanceGateway(vn, network.FamilyV4)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := d.networks.Lookup(info.Tenant, info.Name, name)
+	if err != nil {
+		return nil, err
+	}
+
+	masterName, peerName, err := d.netns.CreateVethPair(name, metadata.MacAddress)
+	if err != nil {
+		return nil, err
+	}
+	tx := network.NewTransaction()
+	tx.Add("veth "+masterName, func() error {
+		return d.netns.DeleteInterface(name, 0)
+	})
+
+	err = d.agent.AddPort(&vrouter.Port{
+		Id:          metadata.NicId,
+		InstanceId:  metadata.InstanceId,
+		DisplayName: name,
+		IpAddress:   metadata.IpAddress,
+		VnId:        vn.GetUuid(),
+		MacAddress:  metadata.MacAddress,
+		SystemName:  masterName,
+		Type:        vrouter.PortTypeVM,
+		RxVlanId:    -1,
+		TxVlanId:    -1,
+	})
+	if err != nil {
+		return nil, tx.Fail("vrouter port", err)
+	}
+
+	response := &joinResponse{
+		InterfaceName: interfaceName{SrcName: peerName, DstPrefix: "eth"},
+		Gateway:       gateway,
+	}
+	return response, nil
+}
+
+func (d *Driver) leave(body []byte) (interface{}, error) {
+	var request endpointRequest
+	if err := decode(body, &request); err != nil {
+		return nil, err
+	}
+	info, err := d.lookupNetwork(request.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	name, err := instanceName(request.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := d.networks.Lookup(info.Tenant, info.Name, name)
+	if err != nil {
+		log.Warning("Lookup %s: %v", name, err)
+	}
+	if metadata != nil && metadata.NicId != "" {
+		err = d.agent.DeletePort(metadata.NicId)
+		if err != nil && !vrouter.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
+	if err := d.netns.DeleteInterface(name, 0); err != nil {
+		return nil, err
+	}
+	return map[string]string{}, nil
+}
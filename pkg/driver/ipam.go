@@ -0,0 +1,201 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pedro-r-marques/packnet/pkg/network"
+)
+
+const (
+	addressSpace = "packnet"
+	poolId       = "packnet"
+
+	gatewayOption = "com.docker.network.gateway"
+)
+
+func (d *Driver) ipamGetCapabilities(body []byte) (interface{}, error) {
+	return map[string]bool{"RequiresMACAddress": false}, nil
+}
+
+func (d *Driver) getDefaultAddressSpaces(body []byte) (interface{}, error) {
+	response := map[string]string{
+		"LocalDefaultAddressSpace":  addressSpace,
+		"GlobalDefaultAddressSpace": addressSpace,
+	}
+	return response, nil
+}
+
+// poolGateway returns the address of the gateway in the private subnet along
+// with the prefix length. OpenContrail assigns the first host address.
+func (d *Driver) poolGateway() (string, int, error) {
+	_, subnet, err := net.ParseCIDR(d.privateSubnet)
+	if err != nil {
+		return "", 0, err
+	}
+	gateway := subnet.IP.To4()
+	if gateway == nil {
+		return "", 0, fmt.Errorf("%s is not an IPv4 subnet", d.privateSubnet)
+	}
+	gateway = append(net.IP(nil), gateway...)
+	gateway[3]++
+	prefixLen, _ := subnet.Mask.Size()
+	return gateway.String(), prefixLen, nil
+}
+
+type requestPoolRequest struct {
+	AddressSpace string
+	Pool         string
+	SubPool      string
+	V6           bool
+}
+
+type requestPoolResponse struct {
+	PoolID string
+	Pool   string
+	Data   map[string]string
+}
+
+// requestPool returns the allocator private subnet: all packnet addresses are
+// allocated from a single pool.
+func (d *Driver) requestPool(body []byte) (interface{}, error) {
+	var request requestPoolRequest
+	if err := decode(body, &request); err != nil {
+		return nil, err
+	}
+	if request.V6 {
+		return nil, fmt.Errorf("IPv6 pools are not supported")
+	}
+	if request.Pool != "" && request.Pool != d.privateSubnet {
+		return nil, fmt.Errorf("pool %s not available; only %s is supported", request.Pool, d.privateSubnet)
+	}
+	gateway, prefixLen, err := d.poolGateway()
+	if err != nil {
+		return nil, err
+	}
+
+	response := &requestPoolResponse{
+		PoolID: poolId,
+		Pool:   d.privateSubnet,
+		Data:   map[string]string{gatewayOption: fmt.Sprintf("%s/%d", gateway, prefixLen)},
+	}
+	return response, nil
+}
+
+func isGatewayRequest(options map[string]string) bool {
+	return strings.HasSuffix(options["RequestAddressType"], ".gateway")
+}
+
+type requestAddressRequest struct {
+	PoolID  string
+	Address string
+	Options map[string]string
+}
+
+type requestAddressResponse struct {
+	Address string
+	Data    map[string]string
+}
+
+func allocatorKey() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "docker-" + hex.EncodeToString(buf), nil
+}
+
+func (d *Driver) requestAddress(body []byte) (interface{}, error) {
+	var request requestAddressRequest
+	if err := decode(body, &request); err != nil {
+		return nil, err
+	}
+	gateway, prefixLen, err := d.poolGateway()
+	if err != nil {
+		return nil, err
+	}
+	if isGatewayRequest(request.Options) {
+		return &requestAddressResponse{Address: fmt.Sprintf("%s/%d", gateway, prefixLen)}, nil
+	}
+	if request.Address != "" {
+		return nil, fmt.Errorf("static address assignment is not supported")
+	}
+
+	key, err := allocatorKey()
+	if err != nil {
+		return nil, err
+	}
+	address, err := d.allocator.LocateIpAddress(key, network.FamilyV4)
+	if err != nil {
+		return nil, err
+	}
+	tx := network.NewTransaction()
+	tx.Add("address "+address, func() error {
+		_, err := d.allocator.ReleaseIpAddress(key)
+		return err
+	})
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.state.Addresses[address] = key
+	if err := d.save(); err != nil {
+		delete(d.state.Addresses, address)
+		return nil, tx.Fail("save state", err)
+	}
+	return &requestAddressResponse{Address: fmt.Sprintf("%s/%d", address, prefixLen)}, nil
+}
+
+type releaseAddressRequest struct {
+	PoolID  string
+	Address string
+}
+
+func (d *Driver) releaseAddress(body []byte) (interface{}, error) {
+	var request releaseAddressRequest
+	if err := decode(body, &request); err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	key, ok := d.state.Addresses[request.Address]
+	if !ok {
+		log.Warning("Release address %s: not allocated by packnet", request.Address)
+		return map[string]string{}, nil
+	}
+	// Forget the address before releasing it, so that the state never
+	// maps an address that the allocator may hand out again.
+	delete(d.state.Addresses, request.Address)
+	if err := d.save(); err != nil {
+		d.state.Addresses[request.Address] = key
+		return nil, err
+	}
+	if _, err := d.allocator.ReleaseIpAddress(key); err != nil {
+		// Keep the mapping so that a retry finds the allocation key.
+		d.state.Addresses[request.Address] = key
+		if err := d.save(); err != nil {
+			log.Error("Save driver state: %v", err)
+		}
+		return nil, err
+	}
+	return map[string]string{}, nil
+}
@@ -17,69 +17,118 @@ limitations under the License.
 package network
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/Juniper/contrail-go-api"
-	"github.com/Juniper/contrail-go-api/config"
 	"github.com/Juniper/contrail-go-api/types"
 )
 
 type AddressAllocator interface {
-	LocateIpAddress(uid string) (string, error)
-	ReleaseIpAddress(uid string)
+	LocateIpAddress(uid, family string) (string, error)
+	// ReserveIpAddress allocates the given address to uid. It returns a
+	// *ConflictError when the address is allocated to another key.
+	ReserveIpAddress(uid, family, address string) error
+	// ReleaseIpAddress releases the addresses allocated to uid. It reports
+	// whether any address was released.
+	ReleaseIpAddress(uid string) (bool, error)
 }
 
 // Allocate an unique address for each Pod.
 type AddressAllocatorImpl struct {
-	client        contrail.ApiClient
-	network       *types.VirtualNetwork
-	privateSubnet string
+	client  contrail.ApiClient
+	network *types.VirtualNetwork
+	// Prefixes of the allocation network, at most one per address family.
+	prefixes []string
 }
 
 const (
 	AddressAllocationNetwork = "default-domain:default-project:addr-alloc"
 )
 
-func NewAddressAllocator(client contrail.ApiClient, privateSubnet string) AddressAllocator {
-	a := &AddressAllocatorImpl{
-		client:        client,
-		privateSubnet: privateSubnet,
+// Address allocator backends.
+const (
+	AllocatorContrail = "contrail" // instance-ips in AddressAllocationNetwork
+	AllocatorLocal    = "local"    // host-local bitmap, see BitmapAllocator
+	AllocatorFile     = "file"     // host-local lease files, see FileAllocator
+)
+
+// NewAllocator returns an allocator of the given kind for privateSubnet. The
+// host-local backends keep their state under stateDir.
+func NewAllocator(kind string, client contrail.ApiClient, privateSubnet, stateDir string) (AddressAllocator, error) {
+	switch kind {
+	case AllocatorContrail, "":
+		return NewAddressAllocator(client, privateSubnet)
+	case AllocatorLocal:
+		return NewBitmapAllocator(privateSubnet, stateDir)
+	case AllocatorFile:
+		return NewFileAllocator(privateSubnet, stateDir)
 	}
+	return nil, fmt.Errorf("unknown allocator %q", kind)
+}
 
-	a.network = a.initializeAllocatorNetwork()
+// NewAddressAllocator returns the allocator for privateSubnet, a comma
+// separated list of an IPv4 and/or an IPv6 prefix. It fails when the
+// allocation network can not be located or created; the API server may be
+// temporarily unavailable, so callers can retry.
+func NewAddressAllocator(client contrail.ApiClient, privateSubnet string) (AddressAllocator, error) {
+	prefixes, err := SplitSubnets(privateSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", privateSubnet, err)
+	}
+	a := &AddressAllocatorImpl{
+		client:   client,
+		prefixes: prefixes,
+	}
 
-	return a
+	a.network, err = a.initializeAllocatorNetwork()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
 }
 
-func (a *AddressAllocatorImpl) initializeAllocatorNetwork() *types.VirtualNetwork {
+func (a *AddressAllocatorImpl) initializeAllocatorNetwork() (*types.VirtualNetwork, error) {
 	vn, err := types.VirtualNetworkByName(a.client, AddressAllocationNetwork)
 	if err == nil {
-		return vn
+		return vn, nil
+	} else if !isNotFound(err) {
+		return nil, fmt.Errorf("%s: %v", AddressAllocationNetwork, err)
 	}
 
 	fqn := strings.Split(AddressAllocationNetwork, ":")
 	parent := strings.Join(fqn[0:len(fqn)-1], ":")
 	projectId, err := a.client.UuidByName("project", parent)
 	if err != nil {
-		log.Fatalf("%s: %v", parent, err)
+		return nil, fmt.Errorf("%s: %v", parent, err)
 	}
 
-	netId, err := config.CreateNetworkWithSubnet(a.client, projectId, fqn[len(fqn)-1], a.privateSubnet)
+	netId, err := createNetworkWithSubnets(a.client, projectId, fqn[len(fqn)-1], a.prefixes)
 	if err != nil {
-		log.Fatalf("%s: %v", parent, err)
+		return nil, fmt.Errorf("%s: %v", AddressAllocationNetwork, err)
 	}
 	log.Info("Created network %s", AddressAllocationNetwork)
 	network, err := types.VirtualNetworkByUuid(a.client, netId)
 	if err != nil {
-		log.Fatalf("Get virtual-network %s: %v", netId, err)
+		return nil, fmt.Errorf("Get virtual-network %s: %v", netId, err)
 	}
-	return network
+	return network, nil
 }
 
-func (a *AddressAllocatorImpl) allocateIpAddress(uid string) (contrail.IObject, error) {
+// allocationKey returns the name of the instance-ip that holds the address of
+// the given family allocated to uid.
+func allocationKey(uid, family string) string {
+	if family == FamilyV6 {
+		return uid + "-v6"
+	}
+	return uid
+}
+
+func (a *AddressAllocatorImpl) allocateIpAddress(uid, family string) (contrail.IObject, error) {
 	ipObj := new(types.InstanceIp)
 	ipObj.SetName(uid)
 	ipObj.AddVirtualNetwork(a.network)
+	ipObj.SetInstanceIpFamily(family)
 	err := a.client.Create(ipObj)
 	if err != nil {
 		log.Error("Create InstanceIp %s: %v", uid, err)
@@ -93,10 +142,11 @@ func (a *AddressAllocatorImpl) allocateIpAddress(uid string) (contrail.IObject,
 	return obj, err
 }
 
-func (a *AddressAllocatorImpl) LocateIpAddress(uid string) (string, error) {
-	obj, err := a.client.FindByName("instance-ip", uid)
+func (a *AddressAllocatorImpl) LocateIpAddress(uid, family string) (string, error) {
+	key := allocationKey(uid, family)
+	obj, err := a.client.FindByName("instance-ip", key)
 	if err != nil {
-		obj, err = a.allocateIpAddress(uid)
+		obj, err = a.allocateIpAddress(key, family)
 		if err != nil {
 			return "", err
 		}
@@ -106,12 +156,64 @@ func (a *AddressAllocatorImpl) LocateIpAddress(uid string) (string, error) {
 	return ipObj.GetInstanceIpAddress(), nil
 }
 
-func (a *AddressAllocatorImpl) ReleaseIpAddress(uid string) {
-	objid, err := a.client.UuidByName("instance-ip", uid)
-	if err != nil {
+func (a *AddressAllocatorImpl) ReserveIpAddress(uid, family, address string) error {
+	key := allocationKey(uid, family)
+	obj, err := a.client.FindByName("instance-ip", key)
+	if err == nil {
+		current := obj.(*types.InstanceIp).GetInstanceIpAddress()
+		if current != address {
+			return fmt.Errorf("%s already holds address %s", uid, current)
+		}
+		return nil
+	} else if !isNotFound(err) {
+		return err
+	}
+
+	ipObj := new(types.InstanceIp)
+	ipObj.SetName(key)
+	ipObj.AddVirtualNetwork(a.network)
+	ipObj.SetInstanceIpFamily(family)
+	ipObj.SetInstanceIpAddress(address)
+	err = a.client.Create(ipObj)
+	if isConflict(err) {
+		return &ConflictError{Kind: "address", Address: address}
+	} else if err != nil {
+		log.Error("Create InstanceIp %s: %v", key, err)
+		return err
+	}
+	return nil
+}
+
+// ReleaseIpAddress releases the addresses of both families allocated to uid.
+// Releasing an address that is not allocated is not an error. An address is
+// only considered released once its instance-ip can no longer be found.
+func (a *AddressAllocatorImpl) ReleaseIpAddress(uid string) (bool, error) {
+	released := false
+	for _, family := range []string{FamilyV4, FamilyV6} {
+		key := allocationKey(uid, family)
+		objid, err := a.client.UuidByName("instance-ip", key)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return released, fmt.Errorf("lookup instance-ip %s: %v", key, err)
+		}
+
 		err = a.client.DeleteByUuid("instance-ip", objid)
-		if err != nil {
-			log.Warning("Delete instance-ip: %v", err)
+		if err != nil && !isNotFound(err) {
+			return released, fmt.Errorf("delete instance-ip %s: %v", key, err)
+		}
+		deleted := err == nil
+
+		_, err = a.client.FindByUuid("instance-ip", objid)
+		if err == nil {
+			return released, fmt.Errorf("instance-ip %s still allocated after delete", key)
+		} else if !isNotFound(err) {
+			return released, fmt.Errorf("verify release of instance-ip %s: %v", key, err)
+		}
+		if deleted {
+			log.Debug("Released instance-ip %s", key)
+			released = true
 		}
 	}
+	return released, nil
 }
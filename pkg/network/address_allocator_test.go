@@ -0,0 +1,247 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Juniper/contrail-go-api"
+	"github.com/Juniper/contrail-go-api/types"
+)
+
+// mockClient is an in-memory contrail.ApiClient that names objects by type
+// and fully qualified name. Its errors have the form of the API server
+// responses.
+type mockClient struct {
+	objects map[string]contrail.IObject // by uuid
+	nextId  int
+	// Returned by UuidByName and FindByName when set.
+	lookupErr error
+	// Returned by Delete and DeleteByUuid when set.
+	deleteErr error
+	// Makes deletes succeed without removing the object.
+	keepDeleted bool
+}
+
+func newMockClient() *mockClient {
+	return &mockClient{objects: make(map[string]contrail.IObject)}
+}
+
+func notFound(what string) error {
+	return fmt.Errorf("404 Not Found: %s", what)
+}
+
+func (c *mockClient) lookup(typename, fqn string) (contrail.IObject, error) {
+	if c.lookupErr != nil {
+		return nil, c.lookupErr
+	}
+	for _, obj := range c.objects {
+		if obj.GetType() == typename && strings.Join(obj.GetFQName(), ":") == fqn {
+			return obj, nil
+		}
+	}
+	return nil, notFound(typename + " " + fqn)
+}
+
+func (c *mockClient) Create(obj contrail.IObject) error {
+	fqn := strings.Join(obj.GetFQName(), ":")
+	if _, err := c.lookup(obj.GetType(), fqn); err == nil {
+		return fmt.Errorf("409 Conflict: %s %s", obj.GetType(), fqn)
+	}
+	c.nextId++
+	if obj.GetUuid() == "" {
+		obj.SetUuid(fmt.Sprintf("00000000-0000-0000-0000-%012d", c.nextId))
+	}
+	// As the API server, assign a mac address to interfaces without one.
+	if nic, ok := obj.(*types.VirtualMachineInterface); ok {
+		if len(nic.GetVirtualMachineInterfaceMacAddresses().MacAddress) == 0 {
+			nic.SetVirtualMachineInterfaceMacAddresses(&types.MacAddressesType{
+				MacAddress: []string{fmt.Sprintf("02:00:00:00:00:%02x", c.nextId)},
+			})
+		}
+	}
+	c.objects[obj.GetUuid()] = obj
+	return nil
+}
+
+func (c *mockClient) Update(obj contrail.IObject) error {
+	if _, ok := c.objects[obj.GetUuid()]; !ok {
+		return notFound(obj.GetUuid())
+	}
+	c.objects[obj.GetUuid()] = obj
+	return nil
+}
+
+func (c *mockClient) DeleteByUuid(typename, uuid string) error {
+	if c.deleteErr != nil {
+		return c.deleteErr
+	}
+	if _, ok := c.objects[uuid]; !ok {
+		return notFound(uuid)
+	}
+	if !c.keepDeleted {
+		delete(c.objects, uuid)
+	}
+	return nil
+}
+
+func (c *mockClient) Delete(obj contrail.IObject) error {
+	return c.DeleteByUuid(obj.GetType(), obj.GetUuid())
+}
+
+func (c *mockClient) FindByUuid(typename, uuid string) (contrail.IObject, error) {
+	obj, ok := c.objects[uuid]
+	if !ok {
+		return nil, notFound(uuid)
+	}
+	return obj, nil
+}
+
+func (c *mockClient) UuidByName(typename, fqn string) (string, error) {
+	obj, err := c.lookup(typename, fqn)
+	if err != nil {
+		return "", err
+	}
+	return obj.GetUuid(), nil
+}
+
+func (c *mockClient) FQNameByUuid(uuid string) ([]string, error) {
+	obj, ok := c.objects[uuid]
+	if !ok {
+		return nil, notFound(uuid)
+	}
+	return obj.GetFQName(), nil
+}
+
+func (c *mockClient) FindByName(typename, fqn string) (contrail.IObject, error) {
+	return c.lookup(typename, fqn)
+}
+
+func (c *mockClient) List(typename string) ([]contrail.ListResult, error) {
+	return nil, fmt.Errorf("List not supported")
+}
+
+func (c *mockClient) ListByParent(typename, parentID string) ([]contrail.ListResult, error) {
+	return nil, fmt.Errorf("ListByParent not supported")
+}
+
+func (c *mockClient) ListDetail(typename string, fields []string) ([]contrail.IObject, error) {
+	var objects []contrail.IObject
+	for _, obj := range c.objects {
+		if obj.GetType() == typename {
+			objects = append(objects, obj)
+		}
+	}
+	return objects, nil
+}
+
+func (c *mockClient) ListDetailByParent(typename, parentID string, fields []string) ([]contrail.IObject, error) {
+	return nil, fmt.Errorf("ListDetailByParent not supported")
+}
+
+// addInstanceIp adds an instance-ip named name to the client.
+func (c *mockClient) addInstanceIp(name string) {
+	obj := new(types.InstanceIp)
+	obj.SetName(name)
+	c.Create(obj)
+}
+
+func TestReleaseIpAddress(t *testing.T) {
+	const uid = "7c2f6a3e-4b0d-4e6b-9a51-0d3c5f2e8b14"
+	tests := []struct {
+		name     string
+		keys     []string // instance-ips present before the release
+		setup    func(c *mockClient)
+		released bool
+		err      string // substring of the expected error
+		left     int    // instance-ips left after the release
+	}{
+		{
+			name:     "released",
+			keys:     []string{uid},
+			released: true,
+		},
+		{
+			name:     "both families",
+			keys:     []string{uid, allocationKey(uid, FamilyV6)},
+			released: true,
+		},
+		{
+			name: "already gone",
+		},
+		{
+			name: "other keys kept",
+			keys: []string{"e1b3c0a2-5f4d-4c1e-8a2b-3d4e5f6a7b8c"},
+			left: 1,
+		},
+		{
+			name: "delete fails",
+			keys: []string{uid},
+			setup: func(c *mockClient) {
+				c.deleteErr = fmt.Errorf("500 Internal Server Error: database unavailable")
+			},
+			err:  "delete instance-ip " + uid,
+			left: 1,
+		},
+		{
+			name: "still present after delete",
+			keys: []string{uid},
+			setup: func(c *mockClient) {
+				c.keepDeleted = true
+			},
+			err:  "still allocated after delete",
+			left: 1,
+		},
+		{
+			// A transport error that happens to contain 404 is not an
+			// absent object.
+			name: "lookup fails",
+			keys: []string{uid},
+			setup: func(c *mockClient) {
+				c.lookupErr = fmt.Errorf("dial tcp 10.0.4.4:4404: connection refused")
+			},
+			err:  "lookup instance-ip " + uid,
+			left: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		client := newMockClient()
+		for _, key := range tt.keys {
+			client.addInstanceIp(key)
+		}
+		if tt.setup != nil {
+			tt.setup(client)
+		}
+		allocator := &AddressAllocatorImpl{client: client}
+
+		released, err := allocator.ReleaseIpAddress(uid)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: expected error %q, got %v", tt.name, tt.err, err)
+		}
+		if released != tt.released {
+			t.Errorf("%s: released %v, expected %v", tt.name, released, tt.released)
+		}
+		if len(client.objects) != tt.left {
+			t.Errorf("%s: %d instance-ips left, expected %d", tt.name, len(client.objects), tt.left)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileAllocator keeps one lease file per allocated address, named after the
+// address and holding the allocation key, in <stateDir>/ipam/<subnet>.
+type FileAllocator struct {
+	dir   string
+	pools map[string]*localPool
+}
+
+func NewFileAllocator(privateSubnet, stateDir string) (AddressAllocator, error) {
+	pools, err := newLocalPools(privateSubnet)
+	if err != nil {
+		return nil, err
+	}
+	a := &FileAllocator{dir: filepath.Join(stateDir, "ipam"), pools: pools}
+	for _, pool := range pools {
+		if err := os.MkdirAll(a.poolDir(pool), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *FileAllocator) poolDir(pool *localPool) string {
+	return filepath.Join(a.dir, pool.name())
+}
+
+// leases returns the addresses in the pool allocated to uid.
+func (a *FileAllocator) leases(pool *localPool, uid string) ([]string, error) {
+	files, err := ioutil.ReadDir(a.poolDir(pool))
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(a.poolDir(pool), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(data)) == uid {
+			addresses = append(addresses, file.Name())
+		}
+	}
+	return addresses, nil
+}
+
+func (a *FileAllocator) LocateIpAddress(uid, family string) (string, error) {
+	pool, ok := a.pools[family]
+	if !ok {
+		return "", fmt.Errorf("no %s subnet configured", family)
+	}
+	unlock, err := lockFile(filepath.Join(a.poolDir(pool), ".lock"))
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	leases, err := a.leases(pool, uid)
+	if err != nil {
+		return "", err
+	}
+	if len(leases) > 0 {
+		return leases[0], nil
+	}
+
+	first, last := pool.offsets()
+	for offset := first; offset < last; offset++ {
+		address := pool.address(offset)
+		err := a.createLease(pool, uid, address)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return address, nil
+	}
+	return "", fmt.Errorf("no addresses available in %s", pool.prefix)
+}
+
+// createLease creates the lease file of address, failing with an error that
+// satisfies os.IsExist when the address is already leased.
+func (a *FileAllocator) createLease(pool *localPool, uid, address string) error {
+	path := filepath.Join(a.poolDir(pool), address)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(uid)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func (a *FileAllocator) ReserveIpAddress(uid, family, address string) error {
+	pool, ok := a.pools[family]
+	if !ok {
+		return fmt.Errorf("no %s subnet configured", family)
+	}
+	offset, err := pool.offset(address)
+	if err != nil {
+		return err
+	}
+	// Use the canonical form of the address as file name.
+	address = pool.address(offset)
+
+	unlock, err := lockFile(filepath.Join(a.poolDir(pool), ".lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	leases, err := a.leases(pool, uid)
+	if err != nil {
+		return err
+	}
+	if len(leases) > 0 {
+		if leases[0] != address {
+			return fmt.Errorf("%s already holds address %s", uid, leases[0])
+		}
+		return nil
+	}
+
+	err = a.createLease(pool, uid, address)
+	if os.IsExist(err) {
+		owner, _ := ioutil.ReadFile(filepath.Join(a.poolDir(pool), address))
+		return &ConflictError{Kind: "address", Address: address, Owner: strings.TrimSpace(string(owner))}
+	}
+	return err
+}
+
+// ReleaseIpAddress removes the leases of both families held by uid.
+func (a *FileAllocator) ReleaseIpAddress(uid string) (bool, error) {
+	released := false
+	for _, pool := range a.pools {
+		unlock, err := lockFile(filepath.Join(a.poolDir(pool), ".lock"))
+		if err != nil {
+			return released, err
+		}
+		leases, err := a.leases(pool, uid)
+		for _, address := range leases {
+			if err == nil {
+				err = os.Remove(filepath.Join(a.poolDir(pool), address))
+				released = released || err == nil
+			}
+		}
+		unlock()
+		if err != nil {
+			return released, err
+		}
+	}
+	return released, nil
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFileAllocatorLeases checks the lease files, which other tools on the
+// host may read or create.
+func TestFileAllocatorLeases(t *testing.T) {
+	tests := []struct {
+		name    string
+		leases  map[string]string // lease files present before the allocation
+		uid     string
+		family  string
+		reserve string // reserved rather than located when set
+		address string // expected lease file
+	}{
+		{
+			name:    "first address",
+			uid:     "a",
+			family:  FamilyV4,
+			address: "10.1.0.3",
+		},
+		{
+			name:    "leased by another process",
+			leases:  map[string]string{"10.1.0.3": "other\n"},
+			uid:     "a",
+			family:  FamilyV4,
+			address: "10.1.0.4",
+		},
+		{
+			name:    "existing lease",
+			leases:  map[string]string{"10.1.0.4": "a\n"},
+			uid:     "a",
+			family:  FamilyV4,
+			address: "10.1.0.4",
+		},
+		{
+			name:    "canonical ipv6 name",
+			uid:     "a",
+			family:  FamilyV6,
+			reserve: "fd00:1:0:0:0:0:0:5",
+			address: "fd00:1::5",
+		},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		allocator, err := NewFileAllocator(localTestSubnet, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := allocator.(*FileAllocator).pools[tt.family]
+		poolDir := allocator.(*FileAllocator).poolDir(pool)
+		for address, uid := range tt.leases {
+			if err := ioutil.WriteFile(filepath.Join(poolDir, address), []byte(uid), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if tt.reserve != "" {
+			err = allocator.ReserveIpAddress(tt.uid, tt.family, tt.reserve)
+		} else {
+			var address string
+			address, err = allocator.LocateIpAddress(tt.uid, tt.family)
+			if err == nil && address != tt.address {
+				t.Errorf("%s: address %s, expected %s", tt.name, address, tt.address)
+			}
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(poolDir, tt.address))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if string(data) != tt.uid && string(data) != tt.uid+"\n" {
+			t.Errorf("%s: lease of %s holds %q, expected %q", tt.name, tt.address, data, tt.uid)
+		}
+
+		if _, err := allocator.ReleaseIpAddress(tt.uid); err != nil {
+			t.Errorf("%s: release: %v", tt.name, err)
+		}
+		if _, err := os.Stat(filepath.Join(poolDir, tt.address)); !os.IsNotExist(err) {
+			t.Errorf("%s: lease of %s left after the release: %v", tt.name, tt.address, err)
+		}
+	}
+}
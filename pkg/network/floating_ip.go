@@ -0,0 +1,111 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Juniper/contrail-go-api/types"
+)
+
+// locateFloatingIpPool returns the floating-ip-pool with the fully qualified
+// name domain:project:network:pool, creating it on the network when needed.
+func (m *NetworkManagerImpl) locateFloatingIpPool(poolName string) (*types.FloatingIpPool, error) {
+	fqn := strings.Split(poolName, ":")
+	if len(fqn) != 4 {
+		return nil, fmt.Errorf("invalid floating-ip-pool %q: expected domain:project:network:pool", poolName)
+	}
+	pool, err := types.FloatingIpPoolByName(m.client, poolName)
+	if err == nil {
+		return pool, nil
+	} else if !isNotFound(err) {
+		return nil, err
+	}
+
+	networkName := strings.Join(fqn[:3], ":")
+	network, err := types.VirtualNetworkByName(m.client, networkName)
+	if err != nil {
+		return nil, fmt.Errorf("public network %s: %v", networkName, err)
+	}
+	pool = new(types.FloatingIpPool)
+	pool.SetFQName("virtual-network", fqn)
+	if err := m.client.Create(pool); err != nil {
+		return nil, fmt.Errorf("create floating-ip-pool %s: %v", poolName, err)
+	}
+	log.Info("Created floating-ip-pool %s on %s", poolName, network.GetUuid())
+	return pool, nil
+}
+
+// AssociateFloatingIp allocates a floating-ip from the pool, owned by the
+// tenant project, and associates it with the index-th interface of the
+// instance. A non-empty address requests that address from the pool. It
+// returns the floating address.
+func (m *NetworkManagerImpl) AssociateFloatingIp(tx *Transaction, tenant, instanceName string, index int, poolName, address string) (string, error) {
+	pool, err := m.locateFloatingIpPool(poolName)
+	if err != nil {
+		return "", err
+	}
+
+	projectName := fmt.Sprintf("%s:%s", domain, tenant)
+	nicName := InterfaceName(instanceName, index)
+	fqn := append(strings.Split(poolName, ":"), nicName)
+	floatingIp, err := types.FloatingIpByName(m.client, strings.Join(fqn, ":"))
+	if err != nil && !isNotFound(err) {
+		return "", err
+	}
+	if err == nil {
+		if address != "" && floatingIp.GetFloatingIpAddress() != address {
+			return "", fmt.Errorf("floating-ip %s has address %s instead of %s",
+				strings.Join(fqn, ":"), floatingIp.GetFloatingIpAddress(), address)
+		}
+	} else {
+		project, err := types.ProjectByName(m.client, projectName)
+		if err != nil {
+			return "", fmt.Errorf("project %s: %v", projectName, err)
+		}
+		floatingIp = new(types.FloatingIp)
+		floatingIp.SetFQName("floating-ip-pool", fqn)
+		if err := floatingIp.AddProject(project); err != nil {
+			return "", err
+		}
+		if address != "" {
+			floatingIp.SetFloatingIpAddress(address)
+		}
+		if err := m.client.Create(floatingIp); err != nil {
+			if address != "" && isConflict(err) {
+				return "", &ConflictError{Kind: "floating address", Address: address}
+			}
+			return "", fmt.Errorf("create floating-ip in %s: %v", pool.GetName(), err)
+		}
+		uid := floatingIp.GetUuid()
+		tx.Add("floating-ip "+strings.Join(fqn, ":"), func() error {
+			return m.client.DeleteByUuid("floating-ip", uid)
+		})
+		// Read back the address allocated by the API server.
+		floatingIp, err = types.FloatingIpByUuid(m.client, uid)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := m.instanceMgr.AttachFloatingIp(nicName, projectName, floatingIp); err != nil {
+		return "", fmt.Errorf("associate floating-ip with %s: %v", nicName, err)
+	}
+	log.Info("Associated floating-ip %s with %s", floatingIp.GetFloatingIpAddress(), nicName)
+	return floatingIp.GetFloatingIpAddress(), nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Juniper/contrail-go-api/types"
+)
+
+// ManagedInstance identifies a virtual-machine created by packnet. Host is
+// empty for the instances created before the packnet marker was introduced.
+type ManagedInstance struct {
+	Tenant string
+	Name   string
+	Uuid   string
+	Host   string
+}
+
+// GCOptions selects what CollectGarbage collects.
+type GCOptions struct {
+	// Delete the orphans rather than only report them.
+	Apply bool
+	// Collect the instances without the packnet marker whose container is
+	// not running, taking them to have been created on this host.
+	Unmarked bool
+	// Called, when set, before an instance is torn down, to delete the
+	// vrouter ports of its interfaces.
+	DeletePorts func(instance ManagedInstance) error
+}
+
+type GCReport struct {
+	// Instances whose container is gone.
+	Instances []ManagedInstance
+	// Instances without the packnet marker whose container is not running on
+	// this host. Their host is unknown, so they are reported but not deleted
+	// unless GCOptions.Unmarked is set.
+	Unattributed []ManagedInstance
+	// Allocator instance-ips whose interface is gone.
+	Addresses []string
+	// Set when the orphans have been deleted.
+	Applied bool
+}
+
+// ListInstances returns the virtual-machines that carry the packnet marker,
+// along with the unmarked ones that earlier versions created, which are
+// recognized by their container id name.
+func (m *NetworkManagerImpl) ListInstances() ([]ManagedInstance, error) {
+	objects, err := m.client.ListDetail("virtual-machine", []string{"annotations"})
+	if err != nil {
+		return nil, err
+	}
+	var instances []ManagedInstance
+	for _, obj := range objects {
+		instance, ok := obj.(*types.VirtualMachine)
+		fqn := obj.GetFQName()
+		if !ok || len(fqn) != 3 || fqn[0] != domain {
+			continue
+		}
+		host := managedBy(instance)
+		if host == "" && !isContainerName(fqn[2]) {
+			continue
+		}
+		instances = append(instances, ManagedInstance{Tenant: fqn[1], Name: fqn[2], Uuid: obj.GetUuid(), Host: host})
+	}
+	return instances, nil
+}
+
+// isContainerName reports whether s has the form of the instance names that
+// packnet derives from container ids.
+func isContainerName(s string) bool {
+	if len(s) != 10 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// orphanAddresses returns the uuids of the instance-ips of the allocation
+// network that are keyed by a virtual-machine-interface that no longer
+// exists. Keys that are not interface uuids belong to other users of the
+// allocator and are skipped.
+func (m *NetworkManagerImpl) orphanAddresses() ([]string, error) {
+	vn, err := types.VirtualNetworkByName(m.client, AddressAllocationNetwork)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	refs, err := vn.GetInstanceIpBackRefs()
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, ref := range refs {
+		key := strings.TrimSuffix(ref.To[len(ref.To)-1], allocationKey("", FamilyV6))
+		if !isUuid(key) {
+			continue
+		}
+		_, err := m.client.FindByUuid("virtual-machine-interface", key)
+		if err == nil {
+			continue
+		}
+		if !isNotFound(err) {
+			return nil, err
+		}
+		orphans = append(orphans, ref.Uuid)
+	}
+	return orphans, nil
+}
+
+func isUuid(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// CollectGarbage finds the instances created on host that live reports as no
+// longer running, as well as the allocator addresses that are no longer
+// referenced. live maps the names of the known instances to whether their
+// container is running; instances of host that are not in live, such as those
+// of the CNI plugin or the network driver, are left alone. With opts.Apply,
+// the vrouter ports of the instances are deleted, then the instances with
+// Teardown, and the addresses are released.
+func (m *NetworkManagerImpl) CollectGarbage(host string, live map[string]bool, opts *GCOptions) (*GCReport, error) {
+	report := new(GCReport)
+	instances, err := m.ListInstances()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list instances: %v", err)
+	}
+	for _, instance := range instances {
+		running, known := live[instance.Name]
+		switch {
+		case instance.Host == "" && !running && opts.Unmarked:
+			report.Instances = append(report.Instances, instance)
+		case instance.Host == "" && !running:
+			report.Unattributed = append(report.Unattributed, instance)
+		case instance.Host == host && known && !running:
+			report.Instances = append(report.Instances, instance)
+		}
+	}
+
+	if opts.Apply {
+		for _, instance := range report.Instances {
+			if opts.DeletePorts != nil {
+				if err := opts.DeletePorts(instance); err != nil {
+					return report, fmt.Errorf("unable to delete the vrouter ports of %s: %v", instance.Name, err)
+				}
+			}
+			if _, err := m.Teardown(instance.Tenant, "", instance.Name); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	// Computed after the instances have been torn down, since Teardown
+	// releases their addresses.
+	report.Addresses, err = m.orphanAddresses()
+	if err != nil {
+		return report, fmt.Errorf("unable to list allocator addresses: %v", err)
+	}
+
+	if opts.Apply {
+		for _, uuid := range report.Addresses {
+			err := m.client.DeleteByUuid("instance-ip", uuid)
+			if err != nil && !isNotFound(err) {
+				return report, err
+			}
+		}
+		report.Applied = true
+	}
+	return report, nil
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Juniper/contrail-go-api/types"
+)
+
+// addInstance adds a virtual-machine of tenant marked as created on host,
+// or unmarked when host is empty.
+func (c *mockClient) addInstance(tenant, name, host string) {
+	instance := new(types.VirtualMachine)
+	instance.SetFQName("project", instanceFQName(tenant, name))
+	if host != "" {
+		instance.SetAnnotations(&types.KeyValuePairs{
+			KeyValuePair: []types.KeyValuePair{{Key: ManagedAnnotation, Value: host}},
+		})
+	}
+	c.Create(instance)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	const (
+		tenant = "test-tenant"
+		host   = "node1"
+	)
+	instances := map[string]string{ // name to host
+		"000000000a":      host,    // container gone
+		"000000000b":      host,    // running
+		"000000000c":      host,    // no local record
+		"000000000d":      "node2", // other host
+		"000000000e":      "",      // unmarked, not running
+		"000000000f":      "",      // unmarked, running
+		"not-a-container": "",      // unmarked, not created by packnet
+	}
+	live := map[string]bool{
+		"000000000a": false,
+		"000000000b": true,
+		"000000000f": true,
+	}
+
+	tests := []struct {
+		name         string
+		opts         GCOptions
+		collected    []string
+		unattributed []string
+		portsErr     error
+	}{
+		{
+			name:         "dry run",
+			collected:    []string{"000000000a"},
+			unattributed: []string{"000000000e"},
+		},
+		{
+			name:         "apply",
+			opts:         GCOptions{Apply: true},
+			collected:    []string{"000000000a"},
+			unattributed: []string{"000000000e"},
+		},
+		{
+			name:      "apply with unmarked",
+			opts:      GCOptions{Apply: true, Unmarked: true},
+			collected: []string{"000000000a", "000000000e"},
+		},
+		{
+			name:         "port delete fails",
+			opts:         GCOptions{Apply: true},
+			collected:    []string{"000000000a"},
+			unattributed: []string{"000000000e"},
+			portsErr:     fmt.Errorf("vrouter list : connection refused"),
+		},
+	}
+
+	for _, tt := range tests {
+		client := newMockClient()
+		for name, instanceHost := range instances {
+			client.addInstance(tenant, name, instanceHost)
+		}
+		// The ports are deleted while the instance still exists.
+		var ports []string
+		tt.opts.DeletePorts = func(instance ManagedInstance) error {
+			fqn := strings.Join(instanceFQName(instance.Tenant, instance.Name), ":")
+			if _, err := client.FindByName("virtual-machine", fqn); err != nil {
+				t.Errorf("%s: ports of %s deleted after the instance: %v", tt.name, instance.Name, err)
+			}
+			ports = append(ports, instance.Name)
+			return tt.portsErr
+		}
+		manager := NewNetworkManagerWithAllocator(client, "10.0.1.0/24", staticAllocator{})
+
+		report, err := manager.CollectGarbage(host, live, &tt.opts)
+		if tt.portsErr == nil && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		} else if tt.portsErr != nil && err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+		if report == nil {
+			continue
+		}
+		if names := instanceNames(report.Instances); names != strings.Join(tt.collected, ",") {
+			t.Errorf("%s: collected %s, expected %v", tt.name, names, tt.collected)
+		}
+		if names := instanceNames(report.Unattributed); names != strings.Join(tt.unattributed, ",") {
+			t.Errorf("%s: unattributed %s, expected %v", tt.name, names, tt.unattributed)
+		}
+
+		deleted := 0
+		if tt.opts.Apply && tt.portsErr == nil {
+			deleted = len(tt.collected)
+			sort.Strings(ports)
+			if strings.Join(ports, ",") != strings.Join(tt.collected, ",") {
+				t.Errorf("%s: ports deleted for %v, expected %v", tt.name, ports, tt.collected)
+			}
+		}
+		if left := len(instances) - deleted; len(client.objects) != left {
+			t.Errorf("%s: %d instances left, expected %d", tt.name, len(client.objects), left)
+		}
+	}
+}
+
+// instanceNames returns the sorted names of instances, separated by commas.
+func instanceNames(instances []ManagedInstance) string {
+	var names []string
+	for _, instance := range instances {
+		names = append(names, instance.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
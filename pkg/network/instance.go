@@ -18,6 +18,7 @@ package network
 
 import (
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/Juniper/contrail-go-api"
@@ -27,9 +28,17 @@ import (
 type InstanceManager interface {
 	LocateInstance(namespace, packName string) (*types.VirtualMachine, error)
 	LocateInterface(network *types.VirtualNetwork, instance *types.VirtualMachine) (*types.VirtualMachineInterface, error)
+	LocateNamedInterface(network *types.VirtualNetwork, instance *types.VirtualMachine, nicName, macAddress string) (*types.VirtualMachineInterface, error)
 	LocateInstanceIp(network *types.VirtualNetwork, nic *types.VirtualMachineInterface) (*types.InstanceIp, error)
-	LocateInstanceGateway(network *types.VirtualNetwork) (string, error)
+	LocateInstanceIpWithAddress(network *types.VirtualNetwork, nic *types.VirtualMachineInterface, family, address string) (*types.InstanceIp, error)
+	LocateInstanceGateway(network *types.VirtualNetwork, family string) (string, error)
+	LocateInstanceSubnet(network *types.VirtualNetwork, family string) (string, error)
 	LocateMacAddress(fqn string) (string, error)
+	LookupInterface(namespace, packName string) (*types.VirtualMachineInterface, error)
+	ReleaseInterface(namespace, packName string) error
+	ReleaseInstanceIp(namespace, nicName, nicUuid string) error
+	DeleteInstance(uid string) error
+	AttachFloatingIp(packName, projectName string, floatingIp *types.FloatingIp) error
 }
 
 type InstanceManagerImpl struct {
@@ -44,8 +53,31 @@ func NewInstanceManager(client contrail.ApiClient, allocator AddressAllocator) I
 	return manager
 }
 
+// ManagedAnnotation marks the virtual-machines created by packnet, so that
+// they can be told apart from other objects that follow the same naming. Its
+// value is the name of the host where the instance was created.
+const ManagedAnnotation = "packnet.managed"
+
+// managedBy returns the host that created the instance, or "" for instances
+// that were not created by packnet.
+func managedBy(instance *types.VirtualMachine) string {
+	for _, kv := range instance.GetAnnotations().KeyValuePair {
+		if kv.Key == ManagedAnnotation {
+			return kv.Value
+		}
+	}
+	return ""
+}
+
+func setManaged(instance *types.VirtualMachine) {
+	hostname, _ := os.Hostname()
+	instance.SetAnnotations(&types.KeyValuePairs{
+		KeyValuePair: []types.KeyValuePair{{Key: ManagedAnnotation, Value: hostname}},
+	})
+}
+
 func instanceFQName(tenant, packName string) []string {
-	fqn := []string{DefaultDomain, tenant, packName}
+	fqn := []string{domain, tenant, packName}
 	return fqn
 }
 
@@ -58,6 +90,7 @@ func (m *InstanceManagerImpl) LocateInstance(tenant, packName string) (*types.Vi
 
 	instance = new(types.VirtualMachine)
 	instance.SetFQName("project", fqn)
+	setManaged(instance)
 	err = m.client.Create(instance)
 	if err != nil {
 		log.Error("Create %s: %v", packName, err)
@@ -72,7 +105,7 @@ func (m *InstanceManagerImpl) DeleteInstance(uid string) error {
 }
 
 func interfaceFQName(namespace, packName string) []string {
-	fqn := []string{DefaultDomain, namespace, packName}
+	fqn := []string{domain, namespace, packName}
 	return fqn
 }
 
@@ -87,11 +120,23 @@ func (m *InstanceManagerImpl) LookupInterface(namespace, packName string) (*type
 }
 
 func (m *InstanceManagerImpl) LocateInterface(network *types.VirtualNetwork, instance *types.VirtualMachine) (*types.VirtualMachineInterface, error) {
+	return m.LocateNamedInterface(network, instance, instance.GetName(), "")
+}
+
+// LocateNamedInterface locates or creates an interface of the instance, in the
+// same project. Additional interfaces of an instance need distinct names. When
+// macAddress is not empty, the interface is created with that mac address and
+// an existing interface must already have it.
+func (m *InstanceManagerImpl) LocateNamedInterface(network *types.VirtualNetwork, instance *types.VirtualMachine, nicName, macAddress string) (*types.VirtualMachineInterface, error) {
 	namespace := instance.GetFQName()[len(instance.GetFQName())-2]
-	fqn := interfaceFQName(namespace, instance.GetName())
+	fqn := interfaceFQName(namespace, nicName)
 
 	ifc, err := types.VirtualMachineInterfaceByName(m.client, strings.Join(fqn, ":"))
 	if err == nil && ifc != nil {
+		macs := ifc.GetVirtualMachineInterfaceMacAddresses()
+		if macAddress != "" && (len(macs.MacAddress) == 0 || !strings.EqualFold(macs.MacAddress[0], macAddress)) {
+			return nil, fmt.Errorf("interface %s exists with mac address %v, requested %s", nicName, macs.MacAddress, macAddress)
+		}
 		return ifc, nil
 	}
 
@@ -101,9 +146,17 @@ func (m *InstanceManagerImpl) LocateInterface(network *types.VirtualNetwork, ins
 	if network != nil {
 		nic.AddVirtualNetwork(network)
 	}
+	if macAddress != "" {
+		nic.SetVirtualMachineInterfaceMacAddresses(&types.MacAddressesType{
+			MacAddress: []string{macAddress},
+		})
+	}
 	err = m.client.Create(nic)
+	if isConflict(err) && macAddress != "" {
+		return nil, &ConflictError{Kind: "mac address", Address: macAddress}
+	}
 	if err != nil {
-		log.Error("Create interface %s: %v", instance.GetName(), err)
+		log.Error("Create interface %s: %v", nicName, err)
 		return nil, err
 	}
 
@@ -115,6 +168,7 @@ func (m *InstanceManagerImpl) LocateInterface(network *types.VirtualNetwork, ins
 	return nic, nil
 }
 
+// ReleaseInterface deletes the interface packName along with its floating-ips.
 func (m *InstanceManagerImpl) ReleaseInterface(namespace, packName string) error {
 	fqn := interfaceFQName(namespace, packName)
 	vmi, err := types.VirtualMachineInterfaceByName(m.client, strings.Join(fqn, ":"))
@@ -149,18 +203,36 @@ func makeInstanceIpName(tenant, nicName string) string {
 	return tenant + "_" + nicName
 }
 
+// makeFamilyInstanceIpName returns the name of the instance-ip of the given
+// address family. IPv4 instance-ips keep the name given by makeInstanceIpName.
+func makeFamilyInstanceIpName(tenant, nicName, family string) string {
+	if family == FamilyV6 {
+		return makeInstanceIpName(tenant, nicName) + "_v6"
+	}
+	return makeInstanceIpName(tenant, nicName)
+}
+
 func (m *InstanceManagerImpl) LocateInstanceIp(network *types.VirtualNetwork, nic *types.VirtualMachineInterface) (*types.InstanceIp, error) {
+	return m.LocateInstanceIpWithAddress(network, nic, FamilyV4, "")
+}
+
+// LocateInstanceIpWithAddress creates the instance-ip of the given family with
+// the given address, which must have been reserved by the caller. When address
+// is empty, one is obtained from the allocator.
+func (m *InstanceManagerImpl) LocateInstanceIpWithAddress(network *types.VirtualNetwork, nic *types.VirtualMachineInterface, family, address string) (*types.InstanceIp, error) {
 	tenant := nic.GetFQName()[len(nic.GetFQName())-2]
-	ipName := makeInstanceIpName(tenant, nic.GetName())
+	ipName := makeFamilyInstanceIpName(tenant, nic.GetName(), family)
 	instanceIP, err := types.InstanceIpByName(m.client, ipName)
 	if err == nil && instanceIP != nil {
 		// TODO(prm): ensure that attributes are as expected
 		return instanceIP, nil
 	}
 
-	address, err := m.allocator.LocateIpAddress(nic.GetUuid())
-	if err != nil {
-		return nil, err
+	if address == "" {
+		address, err = m.allocator.LocateIpAddress(nic.GetUuid(), family)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Create InstanceIp
@@ -169,7 +241,11 @@ func (m *InstanceManagerImpl) LocateInstanceIp(network *types.VirtualNetwork, ni
 	ipObj.AddVirtualNetwork(network)
 	ipObj.AddVirtualMachineInterface(nic)
 	ipObj.SetInstanceIpAddress(address)
+	ipObj.SetInstanceIpFamily(family)
 	err = m.client.Create(ipObj)
+	if isConflict(err) {
+		return nil, &ConflictError{Kind: "address", Address: address}
+	}
 	if err != nil {
 		log.Error("Create instance-ip %s: %v", nic.GetName(), err)
 		return nil, err
@@ -183,22 +259,31 @@ func (m *InstanceManagerImpl) LocateInstanceIp(network *types.VirtualNetwork, ni
 	return ipObj, nil
 }
 
-func (m *InstanceManagerImpl) ReleaseInstanceIp(namespace, nicName, instanceUID string) error {
-	ipName := makeInstanceIpName(namespace, nicName)
-	instanceIP, err := types.InstanceIpByUuid(m.client, ipName)
-	if err != nil {
-		log.Error("Get instance-ip %s: %v", ipName, err)
-		return err
-	}
-	err = m.client.DeleteByUuid("instance-ip", instanceIP.GetSubnetUuid())
-	if err != nil {
-		log.Error("Delete instance-ip %s: %v", instanceIP.GetSubnetUuid(), err)
+// ReleaseInstanceIp deletes the instance-ips of both address families of the
+// interface nicName and returns their addresses, allocated under the interface
+// uuid, to the allocator. Instance-ips that do not exist are skipped.
+func (m *InstanceManagerImpl) ReleaseInstanceIp(namespace, nicName, nicUuid string) error {
+	for _, family := range []string{FamilyV4, FamilyV6} {
+		ipName := makeFamilyInstanceIpName(namespace, nicName, family)
+		instanceIP, err := types.InstanceIpByName(m.client, ipName)
+		if err == nil {
+			err = m.client.Delete(instanceIP)
+			if err != nil {
+				log.Error("Delete instance-ip %s: %v", instanceIP.GetUuid(), err)
+				return err
+			}
+		} else if !isNotFound(err) {
+			log.Error("Get instance-ip %s: %v", ipName, err)
+			return err
+		}
 	}
 
-	m.allocator.ReleaseIpAddress(instanceUID)
-	return nil
+	_, err := m.allocator.ReleaseIpAddress(nicUuid)
+	return err
 }
 
+// AttachFloatingIp associates the floating-ip with the interface packName of
+// the project projectName. It is a no-op when already associated.
 func (m *InstanceManagerImpl) AttachFloatingIp(packName, projectName string, floatingIp *types.FloatingIp) error {
 	fqn := append(strings.Split(projectName, ":"), packName)
 	vmi, err := types.VirtualMachineInterfaceByName(m.client, strings.Join(fqn, ":"))
@@ -227,21 +312,24 @@ func (m *InstanceManagerImpl) AttachFloatingIp(packName, projectName string, flo
 	return nil
 }
 
-func (m *InstanceManagerImpl) LocateInstanceGateway(network *types.VirtualNetwork) (string, error) {
-	refs, err := network.GetNetworkIpamRefs()
+// LocateInstanceGateway returns the default gateway of the network subnet in
+// the given address family.
+func (m *InstanceManagerImpl) LocateInstanceGateway(network *types.VirtualNetwork, family string) (string, error) {
+	subnet, err := findIpamSubnet(network, family)
 	if err != nil {
-		return "", fmt.Errorf("unable to retrieve network-ipam refs")
-	}
-	if len(refs) == 0 {
-		return "", fmt.Errorf("no refs available.")
+		return "", err
 	}
+	return subnet.DefaultGateway, nil
+}
 
-	attr := refs[0].Attr.(types.VnSubnetsType)
-	if len(attr.IpamSubnets) == 0 {
-		return "", fmt.Errorf("IpamSubnets is empty.")
+// LocateInstanceSubnet returns the prefix, in CIDR notation, from which the
+// network assigns addresses of the given family.
+func (m *InstanceManagerImpl) LocateInstanceSubnet(network *types.VirtualNetwork, family string) (string, error) {
+	subnet, err := findIpamSubnet(network, family)
+	if err != nil {
+		return "", err
 	}
-
-	return attr.IpamSubnets[0].DefaultGateway, nil
+	return fmt.Sprintf("%s/%d", subnet.Subnet.IpPrefix, subnet.Subnet.IpPrefixLen), nil
 }
 
 func (m *InstanceManagerImpl) LocateMacAddress(fqn string) (string, error) {
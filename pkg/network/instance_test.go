@@ -0,0 +1,124 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"testing"
+)
+
+// recordingAllocator is an AddressAllocator that records the released keys.
+type recordingAllocator struct {
+	released []string
+}
+
+func (a *recordingAllocator) LocateIpAddress(uid, family string) (string, error) {
+	return "", fmt.Errorf("LocateIpAddress not supported")
+}
+
+func (a *recordingAllocator) ReserveIpAddress(uid, family, address string) error {
+	return fmt.Errorf("ReserveIpAddress not supported")
+}
+
+func (a *recordingAllocator) ReleaseIpAddress(uid string) (bool, error) {
+	a.released = append(a.released, uid)
+	return true, nil
+}
+
+func TestReleaseInstanceIp(t *testing.T) {
+	const (
+		tenant  = "test-tenant"
+		nicName = "0123456789"
+		nicUuid = "4f1c2d3e-5a6b-4c7d-8e9f-0a1b2c3d4e5f"
+	)
+	v4 := makeFamilyInstanceIpName(tenant, nicName, FamilyV4)
+	v6 := makeFamilyInstanceIpName(tenant, nicName, FamilyV6)
+
+	tests := []struct {
+		name     string
+		names    []string // instance-ips present before the release
+		setup    func(c *mockClient)
+		fail     bool
+		left     int  // instance-ips left after the release
+		released bool // whether the allocator address is released
+	}{
+		{
+			name:     "both families",
+			names:    []string{v4, v6},
+			released: true,
+		},
+		{
+			name:     "ipv4 only",
+			names:    []string{v4},
+			released: true,
+		},
+		{
+			name:     "already gone",
+			released: true,
+		},
+		{
+			name:     "other interface kept",
+			names:    []string{makeInstanceIpName(tenant, "9876543210")},
+			left:     1,
+			released: true,
+		},
+		{
+			name:  "delete fails",
+			names: []string{v4},
+			setup: func(c *mockClient) {
+				c.deleteErr = fmt.Errorf("500 Internal Server Error: database unavailable")
+			},
+			fail: true,
+			left: 1,
+		},
+		{
+			name:  "lookup fails",
+			names: []string{v4},
+			setup: func(c *mockClient) {
+				c.lookupErr = fmt.Errorf("503 Service Unavailable: 404 requests queued")
+			},
+			fail: true,
+			left: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		client := newMockClient()
+		for _, name := range tt.names {
+			client.addInstanceIp(name)
+		}
+		if tt.setup != nil {
+			tt.setup(client)
+		}
+		allocator := new(recordingAllocator)
+		var manager InstanceManager = NewInstanceManager(client, allocator)
+
+		err := manager.ReleaseInstanceIp(tenant, nicName, nicUuid)
+		if tt.fail && err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		} else if !tt.fail && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if len(client.objects) != tt.left {
+			t.Errorf("%s: %d instance-ips left, expected %d", tt.name, len(client.objects), tt.left)
+		}
+		released := len(allocator.released) == 1 && allocator.released[0] == nicUuid
+		if released != tt.released {
+			t.Errorf("%s: allocator released %v, expected release: %v", tt.name, allocator.released, tt.released)
+		}
+	}
+}
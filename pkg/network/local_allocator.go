@@ -0,0 +1,299 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Largest pool, in host bits, managed by the host-local allocators.
+	maxLocalPoolBits = 16
+	// Addresses at the start and at the end of the subnet that are never
+	// allocated: the network address, the gateway and service addresses
+	// used by OpenContrail, and the broadcast address.
+	reservedLow  = 3
+	reservedHigh = 2
+)
+
+// localPool is the range of addresses of one prefix that a host-local
+// allocator hands out.
+type localPool struct {
+	prefix string
+	base   net.IP
+	size   int
+}
+
+// newLocalPools returns a pool per address family of privateSubnet.
+func newLocalPools(privateSubnet string) (map[string]*localPool, error) {
+	prefixes, err := SplitSubnets(privateSubnet)
+	if err != nil {
+		return nil, err
+	}
+	pools := make(map[string]*localPool)
+	for _, prefix := range prefixes {
+		family, _ := prefixFamily(prefix)
+		_, ipnet, _ := net.ParseCIDR(prefix)
+		ones, bits := ipnet.Mask.Size()
+		if bits-ones > maxLocalPoolBits {
+			return nil, fmt.Errorf("%s is too large for a host-local allocator (at most %d host bits)", prefix, maxLocalPoolBits)
+		}
+		size := 1 << uint(bits-ones)
+		if size <= reservedLow+reservedHigh {
+			return nil, fmt.Errorf("%s is too small", prefix)
+		}
+		base := ipnet.IP.To16()
+		if family == FamilyV4 {
+			base = ipnet.IP.To4()
+		}
+		pools[family] = &localPool{prefix: prefix, base: base, size: size}
+	}
+	return pools, nil
+}
+
+func (p *localPool) address(offset int) string {
+	ip := make(net.IP, len(p.base))
+	copy(ip, p.base)
+	for i := len(ip) - 1; i >= 0 && offset > 0; i-- {
+		sum := int(ip[i]) + offset&0xff
+		ip[i] = byte(sum)
+		offset = offset>>8 + sum>>8
+	}
+	return ip.String()
+}
+
+// offset returns the offset of address in the pool. Reserved addresses are
+// rejected.
+func (p *localPool) offset(address string) (int, error) {
+	_, ipnet, _ := net.ParseCIDR(p.prefix)
+	ip := net.ParseIP(address)
+	if ip == nil || !ipnet.Contains(ip) {
+		return 0, fmt.Errorf("address %s is not in %s", address, p.prefix)
+	}
+	if len(p.base) == net.IPv4len {
+		ip = ip.To4()
+	}
+	n := len(ip)
+	offset := int(ip[n-2]-p.base[n-2])<<8 | int(ip[n-1]-p.base[n-1])
+	if first, last := p.offsets(); offset < first || offset >= last {
+		return 0, fmt.Errorf("address %s is reserved", address)
+	}
+	return offset, nil
+}
+
+// offsets returns the range of offsets that may be allocated.
+func (p *localPool) offsets() (int, int) {
+	return reservedLow, p.size - reservedHigh
+}
+
+// name returns a file name derived from the pool prefix.
+func (p *localPool) name() string {
+	return strings.NewReplacer("/", "_", ":", "_").Replace(p.prefix)
+}
+
+// lockFile takes an exclusive lock on path, which is created if needed, so
+// that several packnet processes on the host can share an allocator. The
+// returned function releases the lock.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %v", path, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// BitmapAllocator allocates addresses from a bitmap per pool, kept in a
+// JSON file under <stateDir>/ipam.
+type BitmapAllocator struct {
+	dir   string
+	pools map[string]*localPool
+}
+
+// bitmapState is the on-disk state of a pool.
+type bitmapState struct {
+	Subnet string
+	Bitmap []byte
+	// Allocation key to address offset.
+	Owners map[string]int
+}
+
+func NewBitmapAllocator(privateSubnet, stateDir string) (AddressAllocator, error) {
+	pools, err := newLocalPools(privateSubnet)
+	if err != nil {
+		return nil, err
+	}
+	a := &BitmapAllocator{dir: filepath.Join(stateDir, "ipam"), pools: pools}
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *BitmapAllocator) path(pool *localPool) string {
+	return filepath.Join(a.dir, pool.name()+".json")
+}
+
+func (a *BitmapAllocator) load(pool *localPool) (*bitmapState, error) {
+	state := &bitmapState{
+		Subnet: pool.prefix,
+		Bitmap: make([]byte, (pool.size+7)/8),
+		Owners: make(map[string]int),
+	}
+	data, err := ioutil.ReadFile(a.path(pool))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %v", a.path(pool), err)
+	}
+	if state.Subnet != pool.prefix || len(state.Bitmap) != (pool.size+7)/8 {
+		return nil, fmt.Errorf("%s holds the allocations of %s", a.path(pool), state.Subnet)
+	}
+	return state, nil
+}
+
+func (a *BitmapAllocator) save(pool *localPool, state *bitmapState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(a.dir, pool.name())
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), a.path(pool))
+}
+
+// update runs fn on the state of the pool with the pool locked, and saves
+// the state when fn reports a change.
+func (a *BitmapAllocator) update(pool *localPool, fn func(*bitmapState) (bool, error)) error {
+	unlock, err := lockFile(a.path(pool) + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := a.load(pool)
+	if err != nil {
+		return err
+	}
+	changed, err := fn(state)
+	if err != nil || !changed {
+		return err
+	}
+	return a.save(pool, state)
+}
+
+func (a *BitmapAllocator) LocateIpAddress(uid, family string) (string, error) {
+	pool, ok := a.pools[family]
+	if !ok {
+		return "", fmt.Errorf("no %s subnet configured", family)
+	}
+	address := ""
+	err := a.update(pool, func(state *bitmapState) (bool, error) {
+		if offset, ok := state.Owners[uid]; ok {
+			address = pool.address(offset)
+			return false, nil
+		}
+		first, last := pool.offsets()
+		for offset := first; offset < last; offset++ {
+			if state.Bitmap[offset/8]&(1<<uint(offset%8)) != 0 {
+				continue
+			}
+			state.Bitmap[offset/8] |= 1 << uint(offset%8)
+			state.Owners[uid] = offset
+			address = pool.address(offset)
+			return true, nil
+		}
+		return false, fmt.Errorf("no addresses available in %s", pool.prefix)
+	})
+	return address, err
+}
+
+func (a *BitmapAllocator) ReserveIpAddress(uid, family, address string) error {
+	pool, ok := a.pools[family]
+	if !ok {
+		return fmt.Errorf("no %s subnet configured", family)
+	}
+	offset, err := pool.offset(address)
+	if err != nil {
+		return err
+	}
+	return a.update(pool, func(state *bitmapState) (bool, error) {
+		if current, ok := state.Owners[uid]; ok {
+			if current != offset {
+				return false, fmt.Errorf("%s already holds address %s", uid, pool.address(current))
+			}
+			return false, nil
+		}
+		if state.Bitmap[offset/8]&(1<<uint(offset%8)) != 0 {
+			for owner, o := range state.Owners {
+				if o == offset {
+					return false, &ConflictError{Kind: "address", Address: address, Owner: owner}
+				}
+			}
+			return false, &ConflictError{Kind: "address", Address: address}
+		}
+		state.Bitmap[offset/8] |= 1 << uint(offset%8)
+		state.Owners[uid] = offset
+		return true, nil
+	})
+}
+
+// ReleaseIpAddress releases the addresses of both families allocated to uid.
+func (a *BitmapAllocator) ReleaseIpAddress(uid string) (bool, error) {
+	released := false
+	for _, pool := range a.pools {
+		err := a.update(pool, func(state *bitmapState) (bool, error) {
+			offset, ok := state.Owners[uid]
+			if !ok {
+				return false, nil
+			}
+			state.Bitmap[offset/8] &^= 1 << uint(offset%8)
+			delete(state.Owners, uid)
+			released = true
+			return true, nil
+		})
+		if err != nil {
+			return released, err
+		}
+	}
+	return released, nil
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The host-local allocators, by AllocatorLocal and AllocatorFile.
+var localAllocators = map[string]func(privateSubnet, stateDir string) (AddressAllocator, error){
+	AllocatorLocal: NewBitmapAllocator,
+	AllocatorFile:  NewFileAllocator,
+}
+
+// allocatorStep is an operation on a host-local allocator and its expected
+// outcome.
+type allocatorStep struct {
+	op       string // "locate", "reserve", "release" or "reopen"
+	uid      string
+	family   string // FamilyV4 when empty
+	address  string // requested by reserve, expected from locate
+	released bool   // expected from release
+	err      string // substring of the expected error
+}
+
+// Pools of 8 addresses, of which offsets 3 to 5 can be allocated.
+const localTestSubnet = "10.1.0.0/29,fd00:1::/125"
+
+func TestLocalAllocators(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []allocatorStep
+	}{
+		{
+			name: "pool edges and exhaustion",
+			steps: []allocatorStep{
+				{op: "locate", uid: "a", address: "10.1.0.3"},
+				{op: "locate", uid: "b", address: "10.1.0.4"},
+				{op: "locate", uid: "c", address: "10.1.0.5"},
+				{op: "locate", uid: "d", err: "no addresses available in 10.1.0.0/29"},
+				{op: "locate", uid: "a", address: "10.1.0.3"},
+				{op: "locate", uid: "a", family: FamilyV6, address: "fd00:1::3"},
+			},
+		},
+		{
+			name: "static reservations",
+			steps: []allocatorStep{
+				{op: "reserve", uid: "a", address: "10.1.0.5"},
+				{op: "reserve", uid: "a", address: "10.1.0.5"},
+				{op: "reserve", uid: "a", address: "10.1.0.4", err: "a already holds address 10.1.0.5"},
+				{op: "reserve", uid: "b", address: "10.1.0.5", err: "address 10.1.0.5 is already in use by a"},
+				{op: "reserve", uid: "b", address: "10.1.0.2", err: "reserved"},
+				{op: "reserve", uid: "b", address: "10.1.0.6", err: "reserved"},
+				{op: "reserve", uid: "b", address: "10.2.0.4", err: "not in 10.1.0.0/29"},
+				{op: "reserve", uid: "b", family: FamilyV6, address: "fd00:1:0:0::4"},
+				{op: "locate", uid: "b", family: FamilyV6, address: "fd00:1::4"},
+				{op: "locate", uid: "c", address: "10.1.0.3"},
+				{op: "locate", uid: "d", address: "10.1.0.4"},
+				{op: "reserve", uid: "e", address: "10.1.0.4", err: "address 10.1.0.4 is already in use by d"},
+			},
+		},
+		{
+			name: "release and re-allocation",
+			steps: []allocatorStep{
+				{op: "locate", uid: "a", address: "10.1.0.3"},
+				{op: "locate", uid: "a", family: FamilyV6, address: "fd00:1::3"},
+				{op: "locate", uid: "b", address: "10.1.0.4"},
+				{op: "release", uid: "a", released: true},
+				{op: "release", uid: "a"},
+				{op: "release", uid: "unknown"},
+				{op: "locate", uid: "c", family: FamilyV6, address: "fd00:1::3"},
+				{op: "locate", uid: "c", address: "10.1.0.3"},
+				{op: "reserve", uid: "d", address: "10.1.0.5"},
+				{op: "release", uid: "d", released: true},
+				{op: "reserve", uid: "e", address: "10.1.0.5"},
+			},
+		},
+		{
+			name: "persistence across reopen",
+			steps: []allocatorStep{
+				{op: "locate", uid: "a", address: "10.1.0.3"},
+				{op: "reserve", uid: "b", address: "10.1.0.5"},
+				{op: "reopen"},
+				{op: "locate", uid: "a", address: "10.1.0.3"},
+				{op: "reserve", uid: "c", address: "10.1.0.5", err: "already in use by b"},
+				{op: "locate", uid: "c", address: "10.1.0.4"},
+				{op: "release", uid: "a", released: true},
+				{op: "reopen"},
+				{op: "release", uid: "a"},
+				{op: "locate", uid: "d", address: "10.1.0.3"},
+			},
+		},
+	}
+
+	for kind, newAllocator := range localAllocators {
+		for _, tt := range tests {
+			dir := t.TempDir()
+			allocator, err := newAllocator(localTestSubnet, dir)
+			if err != nil {
+				t.Fatalf("%s: %v", kind, err)
+			}
+			for i, step := range tt.steps {
+				family := step.family
+				if family == "" {
+					family = FamilyV4
+				}
+				var address string
+				var released bool
+				switch step.op {
+				case "locate":
+					address, err = allocator.LocateIpAddress(step.uid, family)
+				case "reserve":
+					err = allocator.ReserveIpAddress(step.uid, family, step.address)
+				case "release":
+					released, err = allocator.ReleaseIpAddress(step.uid)
+				case "reopen":
+					allocator, err = newAllocator(localTestSubnet, dir)
+				}
+				what := fmt.Sprintf("%s: %s: step %d %s %s", kind, tt.name, i, step.op, step.uid)
+				if step.err == "" && err != nil {
+					t.Errorf("%s: unexpected error: %v", what, err)
+				} else if step.err != "" && (err == nil || !strings.Contains(err.Error(), step.err)) {
+					t.Errorf("%s: expected error %q, got %v", what, step.err, err)
+				}
+				if step.op == "locate" && err == nil && address != step.address {
+					t.Errorf("%s: address %s, expected %s", what, address, step.address)
+				}
+				if released != step.released {
+					t.Errorf("%s: released %v, expected %v", what, released, step.released)
+				}
+			}
+		}
+	}
+}
+
+func TestNewLocalPools(t *testing.T) {
+	tests := []struct {
+		subnet string
+		err    string
+	}{
+		{subnet: "10.1.0.0/29"},
+		{subnet: "10.1.0.0/16"},
+		{subnet: "10.1.0.0/15", err: "too large"},
+		{subnet: "10.1.0.0/30", err: "too small"},
+		{subnet: "10.1.0.0/24,10.2.0.0/24", err: "more than one v4 prefix"},
+		{subnet: "10.1.0.0/24,fd00::/112"},
+	}
+
+	for _, tt := range tests {
+		_, err := newLocalPools(tt.subnet)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.subnet, err)
+		} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: expected error %q, got %v", tt.subnet, tt.err, err)
+		}
+	}
+}
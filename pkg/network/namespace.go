@@ -0,0 +1,131 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pedro-r-marques/packnet/pkg/docker"
+)
+
+// Namespace resolver types.
+const (
+	NetnsDocker     = "docker"
+	NetnsPid        = "pid"
+	NetnsPath       = "path"
+	NetnsContainerd = "containerd"
+)
+
+const (
+	ContainerdTaskDir = "/run/containerd/io.containerd.runtime.v2.task"
+)
+
+// NamespaceResolver locates the network namespace of a container and returns
+// a path that can be opened to enter it.
+type NamespaceResolver interface {
+	Resolve(target string) (string, error)
+}
+
+func NewNamespaceResolver(kind, dockerSocket, containerdNamespace string) (NamespaceResolver, error) {
+	switch kind {
+	case NetnsDocker:
+		return &DockerResolver{client: docker.NewClient(dockerSocket)}, nil
+	case NetnsPid:
+		return new(PidResolver), nil
+	case NetnsPath:
+		return new(PathResolver), nil
+	case NetnsContainerd:
+		return &ContainerdResolver{TaskDir: ContainerdTaskDir, Namespace: containerdNamespace}, nil
+	}
+	return nil, fmt.Errorf("unknown namespace type %q", kind)
+}
+
+func pidNetnsPath(pid int) (string, error) {
+	if pid <= 0 {
+		return "", fmt.Errorf("invalid pid %d", pid)
+	}
+	return checkNetnsPath(fmt.Sprintf("/proc/%d/ns/net", pid))
+}
+
+func checkNetnsPath(path string) (string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// DockerResolver resolves a container id or name through the docker daemon.
+type DockerResolver struct {
+	client docker.Client
+}
+
+func (r *DockerResolver) Resolve(target string) (string, error) {
+	container, err := r.client.InspectContainer(target)
+	if err != nil {
+		return "", err
+	}
+	if !container.State.Running {
+		return "", fmt.Errorf("container %s is not running", target)
+	}
+	return pidNetnsPath(container.State.Pid)
+}
+
+// PidResolver resolves the namespace of a process id.
+type PidResolver struct {
+}
+
+func (r *PidResolver) Resolve(target string) (string, error) {
+	pid, err := strconv.Atoi(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid pid %q", target)
+	}
+	return pidNetnsPath(pid)
+}
+
+// PathResolver accepts a bind-mounted namespace such as /var/run/netns/foo or
+// /proc/<pid>/ns/net.
+type PathResolver struct {
+}
+
+func (r *PathResolver) Resolve(target string) (string, error) {
+	return checkNetnsPath(target)
+}
+
+// ContainerdResolver resolves a containerd task through the pid file that
+// the runtime v2 shim keeps in the task state directory.
+type ContainerdResolver struct {
+	TaskDir   string
+	Namespace string
+}
+
+func (r *ContainerdResolver) Resolve(target string) (string, error) {
+	pidFile := filepath.Join(r.TaskDir, r.Namespace, target, "init.pid")
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return "", err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", pidFile, err)
+	}
+	return pidNetnsPath(pid)
+}
@@ -18,16 +18,37 @@ package network
 
 import (
 	"fmt"
-	"os/exec"
-	"strconv"
+	"net"
+	"runtime"
+	"syscall"
 
-	"github.com/docker/libcontainer/netlink"
 	"github.com/milosgajdos83/tenus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 )
 
+// InterfaceConfig describes the index-th interface of a container.
+type InterfaceConfig struct {
+	Index      int
+	Name       string
+	MacAddress string
+	IpAddress  string
+	Gateway    string
+	// Prefix routed through the gateway when the interface does not own the
+	// default route.
+	Subnet string
+	// IPv6 configuration, ignored when IpAddress6 is empty.
+	IpAddress6   string
+	Gateway6     string
+	Subnet6      string
+	DefaultRoute bool
+}
+
 type NetnsManager interface {
-	CreateInterface(dockerId, macAddress, ipAddress, gateway string) (string, error)
-	DeleteInterface(dockerId string) error
+	CreateInterface(containerId, netnsPath string, config *InterfaceConfig) (string, error)
+	CreateVethPair(containerId, macAddress string) (string, string, error)
+	CheckInterface(containerId, netnsPath string, config *InterfaceConfig) error
+	DeleteInterface(containerId string, index int) error
 }
 
 type NetnsManagerImpl struct {
@@ -38,55 +59,344 @@ func NewNetnsManager() NetnsManager {
 	return m
 }
 
-func (m *NetnsManagerImpl) CreateInterface(dockerId, macAddress, ipAddress, gateway string) (string, error) {
-	masterName := fmt.Sprintf("veth-%s", dockerId[0:10])
-	veth, err := tenus.NewVethPairWithOptions(masterName, tenus.VethOptions{PeerName: "veth0"})
+// linkName builds a host interface name that fits in IFNAMSIZ.
+func linkName(prefix, containerId string, index int) string {
+	if index > 0 {
+		prefix = fmt.Sprintf("%s%d", prefix, index)
+	}
+	prefix += "-"
+	n := 15 - len(prefix)
+	if n > 10 {
+		n = 10
+	}
+	if len(containerId) < n {
+		n = len(containerId)
+	}
+	return prefix + containerId[:n]
+}
+
+// HostInterfaceName returns the name of the host side of the veth pair of
+// the index-th interface of a container.
+func HostInterfaceName(containerId string, index int) string {
+	return linkName("veth", containerId, index)
+}
+
+// CreateInterface creates a veth pair for the container and moves the peer
+// into the network namespace at netnsPath (see NamespaceResolver), where it is
+// renamed to config.Name and configured.
+func (m *NetnsManagerImpl) CreateInterface(containerId, netnsPath string, config *InterfaceConfig) (string, error) {
+	masterName := HostInterfaceName(containerId, config.Index)
+	// The peer is created with a temporary name that cannot conflict with
+	// the host interfaces.
+	peerName := linkName("ns", containerId, config.Index)
+	veth, err := tenus.NewVethPairWithOptions(masterName, tenus.VethOptions{PeerName: peerName})
 	if err != nil {
 		return "", err
 	}
-	pid, err := tenus.DockerPidByName(dockerId, "/var/run/docker.sock")
+
+	// Do not leave a partially configured veth pair behind.
+	err = m.setupInterface(veth, netnsPath, peerName, config)
 	if err != nil {
-		return "", err
+		if derr := m.DeleteInterface(containerId, config.Index); derr != nil {
+			log.Warning("Delete interface %s: %v", masterName, derr)
+		}
+		return "", fmt.Errorf("configure %s in container %s: %v", config.Name, containerId, err)
 	}
 
-	peer := veth.PeerNetInterface()
-	if err := netlink.NetworkSetMacAddress(peer, macAddress); err != nil {
-		return "", err
+	return masterName, nil
+}
+
+func (m *NetnsManagerImpl) setupInterface(veth tenus.Vether, netnsPath, peerName string, config *InterfaceConfig) error {
+	if err := setMacAddress(peerName, config.MacAddress); err != nil {
+		return err
 	}
 
-	if err := veth.SetPeerLinkNsPid(pid); err != nil {
-		return "", err
+	ns, err := netns.GetFromPath(netnsPath)
+	if err != nil {
+		return fmt.Errorf("open network namespace %s: %v", netnsPath, err)
+	}
+	defer ns.Close()
+
+	if err := veth.SetPeerLinkNsFd(netnsPath); err != nil {
+		return err
 	}
 
 	if err := veth.SetLinkUp(); err != nil {
-		return "", err
+		return err
 	}
 
-	cmd := exec.Command("nsenter", "-n", "-t", strconv.Itoa(pid),
-		"ip", "link", "set", "veth0", "up")
-	err = cmd.Run()
+	return configureInterface(ns, peerName, config)
+}
+
+// CreateVethPair creates a veth pair with both ends in the host namespace, for
+// runtimes that move the peer into the container and configure it themselves.
+// It returns the names of the host and peer interfaces.
+func (m *NetnsManagerImpl) CreateVethPair(containerId, macAddress string) (string, string, error) {
+	masterName := HostInterfaceName(containerId, 0)
+	peerName := linkName("ns", containerId, 0)
+	veth, err := tenus.NewVethPairWithOptions(masterName, tenus.VethOptions{PeerName: peerName})
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+
+	if err := setMacAddress(peerName, macAddress); err != nil {
+		return "", "", err
 	}
 
-	cmd = exec.Command("nsenter", "-n", "-t", strconv.Itoa(pid), "ip", "addr", "add",
-		fmt.Sprintf("%s/32", ipAddress), "peer", gateway, "dev", "veth0")
-	err = cmd.Run()
+	if err := veth.SetLinkUp(); err != nil {
+		return "", "", err
+	}
+	return masterName, peerName, nil
+}
+
+func setMacAddress(ifname, macAddress string) error {
+	hwaddr, err := net.ParseMAC(macAddress)
 	if err != nil {
-		return "", err
+		return err
+	}
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return fmt.Errorf("lookup %s: %v", ifname, err)
 	}
+	if err := netlink.LinkSetHardwareAddr(link, hwaddr); err != nil {
+		return fmt.Errorf("set %s mac address %s: %v", ifname, macAddress, err)
+	}
+	return nil
+}
+
+// ifaceAddress is an address of a container interface, along with its
+// gateway and the destination routed through it (nil for the default route).
+type ifaceAddress struct {
+	ip  net.IP
+	gw  net.IP
+	dst *net.IPNet
+}
+
+func parseIfaceAddress(address, gateway, subnet string, defaultRoute bool) (*ifaceAddress, error) {
+	a := new(ifaceAddress)
+	if a.ip = net.ParseIP(address); a.ip == nil {
+		return nil, fmt.Errorf("invalid address %q", address)
+	}
+	if a.gw = net.ParseIP(gateway); a.gw == nil {
+		return nil, fmt.Errorf("invalid gateway %q", gateway)
+	}
+	if !defaultRoute {
+		if subnet == "" {
+			return nil, fmt.Errorf("no subnet for %s", address)
+		}
+		var err error
+		if _, a.dst, err = net.ParseCIDR(subnet); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
 
-	cmd = exec.Command("nsenter", "-n", "-t", strconv.Itoa(pid), "ip", "route", "add",
-		"default", "via", gateway)
-	err = cmd.Run()
+// add assigns the host address (/32 or /128) with the gateway as
+// point-to-point peer and adds the route through the gateway.
+func (a *ifaceAddress) add(link netlink.Link) error {
+	bits := 8 * net.IPv4len
+	flags := 0
+	if a.ip.To4() == nil {
+		bits = 8 * net.IPv6len
+		// The address is unique in the network; skip duplicate
+		// address detection so that it is usable immediately.
+		flags = syscall.IFA_F_NODAD
+	}
+	addr := &netlink.Addr{
+		IPNet: &net.IPNet{IP: a.ip, Mask: net.CIDRMask(bits, bits)},
+		Peer:  &net.IPNet{IP: a.gw, Mask: net.CIDRMask(bits, bits)},
+		Flags: flags,
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("add address %s peer %s: %v", a.ip, a.gw, err)
+	}
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: a.dst, Gw: a.gw}
+	if err := netlink.RouteAdd(route); err != nil {
+		return fmt.Errorf("add route %v via %s: %v", a.dst, a.gw, err)
+	}
+	return nil
+}
+
+// check verifies that link carries the address and the route added by add.
+func (a *ifaceAddress) check(link netlink.Link) error {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("list addresses: %v", err)
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.IP.Equal(a.ip) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("address %s not present", a.ip)
 	}
 
-	return masterName, nil
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("list routes: %v", err)
+	}
+	for _, route := range routes {
+		if !route.Gw.Equal(a.gw) {
+			continue
+		}
+		if a.dst == nil {
+			// The default route may be listed without a destination.
+			if route.Dst == nil {
+				return nil
+			}
+			if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+				return nil
+			}
+		} else if route.Dst != nil && route.Dst.String() == a.dst.String() {
+			return nil
+		}
+	}
+	dst := "default"
+	if a.dst != nil {
+		dst = a.dst.String()
+	}
+	return fmt.Errorf("route %s via %s not present", dst, a.gw)
+}
+
+// interfaceAddresses parses the IPv4 and, when configured, the IPv6 address of
+// config.
+func interfaceAddresses(config *InterfaceConfig) ([]*ifaceAddress, error) {
+	v4, err := parseIfaceAddress(config.IpAddress, config.Gateway, config.Subnet, config.DefaultRoute)
+	if err != nil {
+		return nil, err
+	}
+	addresses := []*ifaceAddress{v4}
+	if config.IpAddress6 != "" {
+		v6, err := parseIfaceAddress(config.IpAddress6, config.Gateway6, config.Subnet6, config.DefaultRoute)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, v6)
+	}
+	return addresses, nil
 }
 
-func (m *NetnsManagerImpl) DeleteInterface(dockerId string) error {
-	// masterName := fmt.Sprintf("veth-%s", dockerId[0:10])
+// configureInterface renames the link inside the namespace, brings it up and
+// assigns the IPv4 and, when configured, the IPv6 address. Each family routes
+// either the default route or the interface subnet through its gateway.
+func configureInterface(ns netns.NsHandle, peerName string, config *InterfaceConfig) error {
+	addresses, err := interfaceAddresses(config)
+	if err != nil {
+		return err
+	}
+
+	return withNetns(ns, func() error {
+		link, err := netlink.LinkByName(peerName)
+		if err != nil {
+			return fmt.Errorf("lookup %s: %v", peerName, err)
+		}
+		if err := netlink.LinkSetName(link, config.Name); err != nil {
+			return fmt.Errorf("rename %s to %s: %v", peerName, config.Name, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("set %s up: %v", config.Name, err)
+		}
+		for _, a := range addresses {
+			if err := a.add(link); err != nil {
+				return fmt.Errorf("%s: %v", config.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// withNetns runs fn on a locked OS thread that has entered the namespace ns.
+// If the thread cannot be switched back to its original namespace it is left
+// locked, so that the runtime discards it when the goroutine exits.
+func withNetns(ns netns.NsHandle, fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		origin, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("get current network namespace: %v", err)
+			return
+		}
+		defer origin.Close()
+
+		if err := netns.Set(ns); err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("enter network namespace: %v", err)
+			return
+		}
+		err = fn()
+		if serr := netns.Set(origin); serr != nil {
+			log.Error("Restore network namespace: %v", serr)
+		} else {
+			runtime.UnlockOSThread()
+		}
+		errCh <- err
+	}()
+	return <-errCh
+}
+
+// CheckInterface verifies that the host side of the veth pair exists and that
+// the container interface, in the namespace at netnsPath, is up and carries
+// its mac address, addresses and routes.
+func (m *NetnsManagerImpl) CheckInterface(containerId, netnsPath string, config *InterfaceConfig) error {
+	masterName := HostInterfaceName(containerId, config.Index)
+	if _, err := netlink.LinkByName(masterName); err != nil {
+		return fmt.Errorf("lookup %s: %v", masterName, err)
+	}
+	ifname := config.Name
+	addresses, err := interfaceAddresses(config)
+	if err != nil {
+		return err
+	}
+	var hwaddr net.HardwareAddr
+	if config.MacAddress != "" {
+		if hwaddr, err = net.ParseMAC(config.MacAddress); err != nil {
+			return err
+		}
+	}
+
+	ns, err := netns.GetFromPath(netnsPath)
+	if err != nil {
+		return fmt.Errorf("open network namespace %s: %v", netnsPath, err)
+	}
+	defer ns.Close()
+
+	return withNetns(ns, func() error {
+		link, err := netlink.LinkByName(ifname)
+		if err != nil {
+			return fmt.Errorf("lookup %s: %v", ifname, err)
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			return fmt.Errorf("%s is down", ifname)
+		}
+		if hwaddr != nil && link.Attrs().HardwareAddr.String() != hwaddr.String() {
+			return fmt.Errorf("%s has mac address %s, expected %s", ifname, link.Attrs().HardwareAddr, hwaddr)
+		}
+		for _, a := range addresses {
+			if err := a.check(link); err != nil {
+				return fmt.Errorf("%s: %v", ifname, err)
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteInterface removes the host side of the veth pair. The peer in the
+// container namespace is deleted along with it.
+func (m *NetnsManagerImpl) DeleteInterface(containerId string, index int) error {
+	masterName := HostInterfaceName(containerId, index)
+	link, err := netlink.LinkByName(masterName)
+	if err != nil {
+		log.Debug("Interface %s not present: %v", masterName, err)
+		return nil
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("delete %s: %v", masterName, err)
+	}
 	return nil
 }
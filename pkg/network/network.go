@@ -1,7 +1,42 @@
 package network
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/op/go-logging"
 )
 
 var log = logging.MustGetLogger("packnet")
+
+// hasStatus reports whether err is an API server response with the given HTTP
+// status. The client returns these as "<status code> <reason>: <body>".
+func hasStatus(err error, code string) bool {
+	return err != nil && strings.HasPrefix(err.Error(), code+" ")
+}
+
+// isNotFound reports whether err is the API server response for an object
+// that does not exist.
+func isNotFound(err error) bool {
+	return hasStatus(err, "404")
+}
+
+// isConflict reports whether err is the API server response for a request
+// that conflicts with an existing object.
+func isConflict(err error) bool {
+	return hasStatus(err, "409")
+}
+
+// ConflictError reports a requested address that is already in use.
+type ConflictError struct {
+	Kind    string // "address", "mac address" or "floating address"
+	Address string
+	Owner   string // may be empty when unknown
+}
+
+func (e *ConflictError) Error() string {
+	if e.Owner == "" {
+		return fmt.Sprintf("%s %s is already in use", e.Kind, e.Address)
+	}
+	return fmt.Sprintf("%s %s is already in use by %s", e.Kind, e.Address, e.Owner)
+}
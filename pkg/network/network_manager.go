@@ -18,10 +18,10 @@ package network
 
 import (
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/Juniper/contrail-go-api"
-	"github.com/Juniper/contrail-go-api/config"
 	"github.com/Juniper/contrail-go-api/types"
 )
 
@@ -29,16 +29,110 @@ const (
 	DefaultDomain = "default-domain"
 )
 
+// domain is the OpenContrail domain of the tenant projects.
+var domain = DefaultDomain
+
+// SetDomain sets the domain of the tenant projects, DefaultDomain unless
+// set. It must be called before any manager is used.
+func SetDomain(name string) {
+	domain = name
+}
+
+// Domain returns the domain of the tenant projects.
+func Domain() string {
+	return domain
+}
+
 type InstanceMetadata struct {
 	InstanceId string
 	NicId      string
+	NetworkId  string
 	MacAddress string
 	IpAddress  string
 	Gateway    string
+	Subnet     string
+	// IPv6 configuration, set when the network has an IPv6 subnet.
+	IpAddress6 string
+	Gateway6   string
+	Subnet6    string
+}
+
+// InterfaceName returns the name of the virtual-machine-interface that
+// connects an instance to its index-th network. The first interface has the
+// name of the instance.
+func InterfaceName(instanceName string, index int) string {
+	if index == 0 {
+		return instanceName
+	}
+	return fmt.Sprintf("%s-%d", instanceName, index)
+}
+
+// InterfaceRequest carries the static configuration requested for an
+// interface. Empty fields are assigned dynamically.
+type InterfaceRequest struct {
+	IpAddress  string
+	IpAddress6 string
+	MacAddress string
+}
+
+// address returns the requested address of the given family.
+func (r *InterfaceRequest) address(family string) string {
+	if r == nil {
+		return ""
+	}
+	if family == FamilyV6 {
+		return r.IpAddress6
+	}
+	return r.IpAddress
+}
+
+// validate checks the requested addresses against the subnets of the network.
+func (r *InterfaceRequest) validate(network *types.VirtualNetwork) error {
+	if r == nil {
+		return nil
+	}
+	if r.MacAddress != "" {
+		if _, err := net.ParseMAC(r.MacAddress); err != nil {
+			return err
+		}
+	}
+	for _, family := range []string{FamilyV4, FamilyV6} {
+		address := r.address(family)
+		if address == "" {
+			continue
+		}
+		ip := net.ParseIP(address)
+		if ip == nil || (ip.To4() != nil) != (family == FamilyV4) {
+			return fmt.Errorf("invalid %s address %q", family, address)
+		}
+		subnet, err := findIpamSubnet(network, family)
+		if err != nil {
+			return err
+		}
+		prefix := fmt.Sprintf("%s/%d", subnet.Subnet.IpPrefix, subnet.Subnet.IpPrefixLen)
+		_, ipnet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return err
+		}
+		if !ipnet.Contains(ip) {
+			return fmt.Errorf("address %s is not in subnet %s of network %s", address, prefix, network.GetName())
+		}
+	}
+	return nil
 }
 
 type NetworkManager interface {
 	Build(tenant, network, instanceName string) (*InstanceMetadata, error)
+	BuildWithTransaction(tx *Transaction, tenant, network, instanceName string) (*InstanceMetadata, error)
+	BuildInterface(tx *Transaction, tenant, network, instanceName string, index int, req *InterfaceRequest) (*InstanceMetadata, error)
+	Lookup(tenant, network, instanceName string) (*InstanceMetadata, error)
+	LookupInterface(tenant, network, instanceName string, index int) (*InstanceMetadata, error)
+	AssociateFloatingIp(tx *Transaction, tenant, instanceName string, index int, pool, address string) (string, error)
+	Teardown(tenant, network, instanceName string) (*TeardownReport, error)
+	LocateNetwork(tenant, network string) (*types.VirtualNetwork, error)
+	Repair(tenant, network, instanceName string, index int, mdata *InstanceMetadata, pool, floatingIp string) ([]string, error)
+	ListInstances() ([]ManagedInstance, error)
+	CollectGarbage(host string, live map[string]bool, opts *GCOptions) (*GCReport, error)
 }
 
 type NetworkManagerImpl struct {
@@ -48,69 +142,236 @@ type NetworkManagerImpl struct {
 	instanceMgr   InstanceManager
 }
 
-func NewNetworkManager(server string, port int, privateSubnet string) NetworkManager {
+// NewNetworkManager returns a manager that creates networks with privateSubnet,
+// an IPv4 prefix optionally followed by a comma and an IPv6 prefix.
+func NewNetworkManager(server string, port int, privateSubnet string) (NetworkManager, error) {
+	return NewNetworkManagerWithClient(contrail.NewClient(server, port), privateSubnet)
+}
+
+func NewNetworkManagerWithClient(client contrail.ApiClient, privateSubnet string) (NetworkManager, error) {
+	allocator, err := NewAddressAllocator(client, privateSubnet)
+	if err != nil {
+		return nil, err
+	}
+	return NewNetworkManagerWithAllocator(client, privateSubnet, allocator), nil
+}
+
+// NewNetworkManagerWithAllocator returns a manager that assigns addresses with
+// the given allocator (see NewAllocator).
+func NewNetworkManagerWithAllocator(client contrail.ApiClient, privateSubnet string, allocator AddressAllocator) NetworkManager {
 	manager := new(NetworkManagerImpl)
-	manager.client = contrail.NewClient(server, port)
+	manager.client = client
 	manager.privateSubnet = privateSubnet
-	manager.allocator = NewAddressAllocator(manager.client, privateSubnet)
+	manager.allocator = allocator
 	manager.instanceMgr = NewInstanceManager(manager.client, manager.allocator)
 	return manager
 }
 
 func (m *NetworkManagerImpl) Build(tenant, networkName, instanceName string) (*InstanceMetadata, error) {
+	tx := NewTransaction()
+	mdata, err := m.BuildWithTransaction(tx, tenant, networkName, instanceName)
+	if err != nil {
+		return nil, tx.Fail("build", err)
+	}
+	return mdata, nil
+}
+
+func (m *NetworkManagerImpl) exists(typename, fqn string) bool {
+	_, err := m.client.UuidByName(typename, fqn)
+	return err == nil
+}
+
+// BuildWithTransaction is Build, recording in tx each object that it creates.
+// Objects that already existed are not recorded, so that a rollback never
+// removes the configuration of an instance that was previously built.
+func (m *NetworkManagerImpl) BuildWithTransaction(tx *Transaction, tenant, networkName, instanceName string) (*InstanceMetadata, error) {
+	return m.BuildInterface(tx, tenant, networkName, instanceName, 0, nil)
+}
+
+// BuildInterface builds the index-th interface of an instance, connected to
+// networkName. All the interfaces of an instance share its virtual-machine.
+// The interface gets the static addresses of req, which may be nil.
+func (m *NetworkManagerImpl) BuildInterface(tx *Transaction, tenant, networkName, instanceName string, index int, req *InterfaceRequest) (*InstanceMetadata, error) {
 	network, err := m.LocateNetwork(tenant, networkName)
-	log.Debug("Located Network: %s", network.GetDisplayName())
 	if err != nil {
-		return nil, fmt.Errorf("unable to loopkup or create network: %s", networkName, err)
+		return nil, fmt.Errorf("unable to lookup or create network %s: %s", networkName, err)
+	}
+	log.Debug("Located Network: %s", network.GetDisplayName())
+	if err := req.validate(network); err != nil {
+		return nil, err
 	}
 
+	fqn := strings.Join(instanceFQName(tenant, instanceName), ":")
+	created := !m.exists("virtual-machine", fqn)
 	instance, err := m.instanceMgr.LocateInstance(tenant, instanceName)
-	log.Debug("Located Instance: %s", instance.GetDisplayName())
 	if err != nil {
 		return nil, fmt.Errorf("unable to lookup or create instance %s: %s", instanceName, err)
 	}
+	log.Debug("Located Instance: %s", instance.GetDisplayName())
+	if created {
+		tx.Add("virtual-machine "+fqn, func() error {
+			return m.instanceMgr.DeleteInstance(instance.GetUuid())
+		})
+	}
 
-	nic, err := m.instanceMgr.LocateInterface(network, instance)
-	log.Debug("Located NIC: %s", nic.GetDisplayName())
+	nicName := InterfaceName(instanceName, index)
+	nicFQN := strings.Join(interfaceFQName(tenant, nicName), ":")
+	created = !m.exists("virtual-machine-interface", nicFQN)
+	macAddress := ""
+	if req != nil {
+		macAddress = req.MacAddress
+	}
+	nic, err := m.instanceMgr.LocateNamedInterface(network, instance, nicName, macAddress)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to lookup or create interface for instance %s: %s", instanceName, err)
 	}
+	log.Debug("Located NIC: %s", nic.GetDisplayName())
+	if created {
+		tx.Add("virtual-machine-interface "+nicFQN, func() error {
+			return m.client.Delete(nic)
+		})
+	}
 
-	ip, err := m.instanceMgr.LocateInstanceIp(network, nic)
-	log.Debug("Located IP: %s", ip.GetDisplayName())
+	mdata := &InstanceMetadata{
+		InstanceId: instance.GetUuid(),
+		NicId:      nic.GetUuid(),
+		NetworkId:  network.GetUuid(),
+	}
+	mdata.IpAddress, mdata.Gateway, mdata.Subnet, err = m.buildInstanceIp(tx, network, nic, tenant, FamilyV4, req.address(FamilyV4))
 	if err != nil {
-		return nil, fmt.Errorf("Unable to lookup or create instance-ip for instance %s: %s", instanceName, err)
+		return nil, err
+	}
+	if _, err := findIpamSubnet(network, FamilyV6); err == nil {
+		mdata.IpAddress6, mdata.Gateway6, mdata.Subnet6, err = m.buildInstanceIp(tx, network, nic, tenant, FamilyV6, req.address(FamilyV6))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	gateway, err := m.instanceMgr.LocateInstanceGateway(network)
-	log.Debug("Located Gateway: %s", gateway)
+	macAddress, err = m.instanceMgr.LocateMacAddress(nicFQN)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to get instance gateway: %s", err)
+		return nil, fmt.Errorf("Unable to get instance mac address: %s", err)
 	}
-
-	macAddress, err := m.instanceMgr.LocateMacAddress(strings.Join(instanceFQName(tenant, instanceName), ":"))
 	log.Debug("Located MacAddress: %s", macAddress)
+	mdata.MacAddress = macAddress
+	return mdata, nil
+}
+
+// buildInstanceIp locates the instance-ip of the given family of an interface
+// and returns its address along with the gateway and prefix of the subnet.
+// A non-empty address is reserved in the allocator and used for the
+// instance-ip; an existing instance-ip must already have it.
+func (m *NetworkManagerImpl) buildInstanceIp(tx *Transaction, network *types.VirtualNetwork,
+	nic *types.VirtualMachineInterface, tenant, family, address string) (string, string, string, error) {
+	ipName := makeFamilyInstanceIpName(tenant, nic.GetName(), family)
+	created := !m.exists("instance-ip", ipName)
+	if created && address != "" {
+		if err := m.allocator.ReserveIpAddress(nic.GetUuid(), family, address); err != nil {
+			return "", "", "", fmt.Errorf("unable to reserve %s for %s: %v", address, nic.GetName(), err)
+		}
+	}
+	if created {
+		// Without an address, the allocator assigns one while creating the
+		// instance-ip; release it even when the creation fails.
+		tx.Add(family+" address of "+nic.GetName(), func() error {
+			_, err := m.allocator.ReleaseIpAddress(nic.GetUuid())
+			return err
+		})
+	}
+	ip, err := m.instanceMgr.LocateInstanceIpWithAddress(network, nic, family, address)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to get instance mac address: %s", err)
+		return "", "", "", fmt.Errorf("Unable to lookup or create %s instance-ip for %s: %s", family, nic.GetName(), err)
+	}
+	log.Debug("Located IP: %s", ip.GetDisplayName())
+	if created {
+		tx.Add("instance-ip "+ipName, func() error {
+			return m.client.Delete(ip)
+		})
+	} else if address != "" && ip.GetInstanceIpAddress() != address {
+		return "", "", "", fmt.Errorf("instance-ip %s has address %s, requested %s", ipName, ip.GetInstanceIpAddress(), address)
 	}
 
+	gateway, err := m.instanceMgr.LocateInstanceGateway(network, family)
+	if err != nil {
+		return "", "", "", fmt.Errorf("Unable to get instance gateway: %s", err)
+	}
+	log.Debug("Located Gateway: %s", gateway)
+
+	subnet, err := m.instanceMgr.LocateInstanceSubnet(network, family)
+	if err != nil {
+		return "", "", "", fmt.Errorf("Unable to get instance subnet: %s", err)
+	}
+	return ip.GetInstanceIpAddress(), gateway, subnet, nil
+}
+
+// Lookup returns the metadata of an instance that has already been built,
+// without creating any objects.
+func (m *NetworkManagerImpl) Lookup(tenant, networkName, instanceName string) (*InstanceMetadata, error) {
+	return m.LookupInterface(tenant, networkName, instanceName, 0)
+}
+
+// LookupInterface is Lookup for the index-th interface of the instance.
+func (m *NetworkManagerImpl) LookupInterface(tenant, networkName, instanceName string, index int) (*InstanceMetadata, error) {
+	fqn := strings.Join(instanceFQName(tenant, instanceName), ":")
+	instance, err := types.VirtualMachineByName(m.client, fqn)
+	if err != nil {
+		return nil, err
+	}
 	mdata := &InstanceMetadata{
 		InstanceId: instance.GetUuid(),
-		NicId:      nic.GetUuid(),
-		MacAddress: macAddress,
-		IpAddress:  ip.GetInstanceIpAddress(),
-		Gateway:    gateway,
+	}
+
+	nic, err := m.instanceMgr.LookupInterface(tenant, InterfaceName(instanceName, index))
+	if err != nil {
+		return mdata, err
+	}
+	mdata.NicId = nic.GetUuid()
+	macs := nic.GetVirtualMachineInterfaceMacAddresses()
+	if len(macs.MacAddress) > 0 {
+		mdata.MacAddress = macs.MacAddress[0]
+	}
+
+	network, err := types.VirtualNetworkByName(m.client, strings.Join([]string{domain, tenant, networkName}, ":"))
+	if err != nil {
+		return mdata, err
+	}
+	mdata.NetworkId = network.GetUuid()
+
+	ip, err := types.InstanceIpByName(m.client, makeInstanceIpName(tenant, nic.GetName()))
+	if err != nil {
+		return mdata, err
+	}
+	mdata.IpAddress = ip.GetInstanceIpAddress()
+	if mdata.Gateway, err = m.instanceMgr.LocateInstanceGateway(network, FamilyV4); err != nil {
+		return mdata, err
+	}
+	if mdata.Subnet, err = m.instanceMgr.LocateInstanceSubnet(network, FamilyV4); err != nil {
+		return mdata, err
+	}
+
+	ip6, err := types.InstanceIpByName(m.client, makeFamilyInstanceIpName(tenant, nic.GetName(), FamilyV6))
+	if isNotFound(err) {
+		return mdata, nil
+	} else if err != nil {
+		return mdata, err
+	}
+	mdata.IpAddress6 = ip6.GetInstanceIpAddress()
+	if mdata.Gateway6, err = m.instanceMgr.LocateInstanceGateway(network, FamilyV6); err != nil {
+		return mdata, err
+	}
+	if mdata.Subnet6, err = m.instanceMgr.LocateInstanceSubnet(network, FamilyV6); err != nil {
+		return mdata, err
 	}
 	return mdata, nil
 }
 
 func (m *NetworkManagerImpl) LocateNetwork(tenant, networkName string) (*types.VirtualNetwork, error) {
-	fqn := []string{DefaultDomain, tenant, networkName}
+	fqn := []string{domain, tenant, networkName}
 	vn, err := types.VirtualNetworkByName(m.client, strings.Join(fqn, ":"))
 
 	// If there is an error since it doesn't exist yet, create it.
 	if err != nil && vn == nil {
-		projectName := fmt.Sprintf("%s:%s", DefaultDomain, tenant)
+		projectName := fmt.Sprintf("%s:%s", domain, tenant)
 
 		log.Debug("ProjectByName: %s", projectName)
 		project, err := types.ProjectByName(m.client, projectName)
@@ -119,8 +380,12 @@ func (m *NetworkManagerImpl) LocateNetwork(tenant, networkName string) (*types.V
 			return nil, err
 		}
 
-		log.Debug("CreateNetworkWithSubnet: project_id=%s, name=%s, prefix=%s", project.GetDisplayName(), networkName, m.privateSubnet)
-		uid, err := config.CreateNetworkWithSubnet(m.client, project.GetUuid(), networkName, m.privateSubnet)
+		prefixes, err := SplitSubnets(m.privateSubnet)
+		if err != nil {
+			return nil, err
+		}
+		log.Debug("CreateNetworkWithSubnets: project_id=%s, name=%s, prefixes=%v", project.GetDisplayName(), networkName, prefixes)
+		uid, err := createNetworkWithSubnets(m.client, project.GetUuid(), networkName, prefixes)
 		if err != nil {
 			log.Error("Create %s: %v", networkName, err)
 			return nil, err
@@ -0,0 +1,121 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Juniper/contrail-go-api/types"
+)
+
+// staticAllocator is an AddressAllocator that assigns a fixed address per
+// address family.
+type staticAllocator map[string]string
+
+func (a staticAllocator) LocateIpAddress(uid, family string) (string, error) {
+	address, ok := a[family]
+	if !ok {
+		return "", fmt.Errorf("no %s address", family)
+	}
+	return address, nil
+}
+
+func (a staticAllocator) ReserveIpAddress(uid, family, address string) error {
+	return fmt.Errorf("ReserveIpAddress not supported")
+}
+
+func (a staticAllocator) ReleaseIpAddress(uid string) (bool, error) {
+	return true, nil
+}
+
+// addNetwork adds a network of tenant with the given ipam subnets.
+func (c *mockClient) addNetwork(tenant, name string, subnets []types.IpamSubnetType) {
+	ipam := new(types.NetworkIpam)
+	ipam.SetFQName("project", []string{DefaultDomain, "default-project", "default-network-ipam"})
+	c.Create(ipam)
+
+	network := new(types.VirtualNetwork)
+	network.SetFQName("project", []string{DefaultDomain, tenant, name})
+	network.AddNetworkIpam(ipam, types.VnSubnetsType{IpamSubnets: subnets})
+	c.Create(network)
+}
+
+// TestLookupBuiltInterface checks that Lookup, as used by CNI CHECK, returns
+// the configuration of the interface that Build created.
+func TestLookupBuiltInterface(t *testing.T) {
+	const (
+		tenant       = "test-tenant"
+		networkName  = "test-net"
+		instanceName = "0123456789"
+	)
+	v4 := types.IpamSubnetType{
+		Subnet:         &types.SubnetType{IpPrefix: "10.0.1.0", IpPrefixLen: 24},
+		DefaultGateway: "10.0.1.1",
+	}
+	v6 := types.IpamSubnetType{
+		Subnet:         &types.SubnetType{IpPrefix: "fd00:1::", IpPrefixLen: 64},
+		DefaultGateway: "fd00:1::1",
+	}
+
+	tests := []struct {
+		name    string
+		subnets []types.IpamSubnetType
+	}{
+		{name: "ipv4", subnets: []types.IpamSubnetType{v4}},
+		{name: "dual stack", subnets: []types.IpamSubnetType{v4, v6}},
+	}
+
+	for _, tt := range tests {
+		client := newMockClient()
+		client.addNetwork(tenant, networkName, tt.subnets)
+		allocator := staticAllocator{FamilyV4: "10.0.1.5", FamilyV6: "fd00:1::5"}
+		manager := NewNetworkManagerWithAllocator(client, "10.0.1.0/24", allocator)
+
+		built, err := manager.Build(tenant, networkName, instanceName)
+		if err != nil {
+			t.Errorf("%s: build: %v", tt.name, err)
+			continue
+		}
+		found, err := manager.Lookup(tenant, networkName, instanceName)
+		if err != nil {
+			t.Errorf("%s: lookup: %v", tt.name, err)
+			continue
+		}
+		if *found != *built {
+			t.Errorf("%s: lookup returned %+v, build %+v", tt.name, *found, *built)
+		}
+
+		config := &InterfaceConfig{
+			Name:         "eth0",
+			MacAddress:   found.MacAddress,
+			IpAddress:    found.IpAddress,
+			Gateway:      found.Gateway,
+			IpAddress6:   found.IpAddress6,
+			Gateway6:     found.Gateway6,
+			DefaultRoute: true,
+		}
+		addresses, err := interfaceAddresses(config)
+		if err != nil {
+			t.Errorf("%s: check configuration: %v", tt.name, err)
+			continue
+		}
+		if len(addresses) != len(tt.subnets) {
+			t.Errorf("%s: %d addresses to check, expected %d", tt.name, len(addresses), len(tt.subnets))
+		}
+	}
+}
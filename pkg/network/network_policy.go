@@ -0,0 +1,241 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Juniper/contrail-go-api"
+	"github.com/Juniper/contrail-go-api/types"
+)
+
+// NetworkPolicyRule allows or denies traffic from the source network to the
+// destination network. Networks are names in the tenant project, fully
+// qualified names (domain:project:network) or "any".
+type NetworkPolicyRule struct {
+	Action           string `yaml:"action"`   // allow (default) or deny
+	Protocol         string `yaml:"protocol"` // any (default), tcp, udp, icmp, icmp6 or a number
+	Source           string `yaml:"source"`
+	SourcePorts      string `yaml:"source_ports"` // "80" or "8000-8080"; any when empty
+	Destination      string `yaml:"destination"`
+	DestinationPorts string `yaml:"destination_ports"`
+	// Match the traffic in both directions instead of only from source to
+	// destination.
+	Bidirectional bool `yaml:"bidirectional"`
+}
+
+// NetworkPolicySpec is the declarative definition of a network policy in the
+// tenant project.
+type NetworkPolicySpec struct {
+	Name  string              `yaml:"name"`
+	Rules []NetworkPolicyRule `yaml:"rules"`
+}
+
+// NetworkPolicyFile is the format of a network policy definition file.
+type NetworkPolicyFile struct {
+	NetworkPolicies []NetworkPolicySpec `yaml:"network_policies"`
+}
+
+type NetworkPolicyManager interface {
+	LocateNetworkPolicy(tenant string, spec *NetworkPolicySpec) (*types.NetworkPolicy, error)
+	AttachNetworkPolicy(policy *types.NetworkPolicy, networks []string) ([]string, error)
+}
+
+type NetworkPolicyManagerImpl struct {
+	client contrail.ApiClient
+}
+
+func NewNetworkPolicyManager(client contrail.ApiClient) NetworkPolicyManager {
+	return &NetworkPolicyManagerImpl{client: client}
+}
+
+// NetworkFQName returns the fully qualified name of a network given either
+// by name in the tenant project or by fully qualified name.
+func NetworkFQName(tenant, name string) []string {
+	if strings.Contains(name, ":") {
+		return strings.Split(name, ":")
+	}
+	return []string{domain, tenant, name}
+}
+
+// Networks returns the fully qualified names of the networks referenced by
+// the rules of the policy.
+func (s *NetworkPolicySpec) Networks(tenant string) []string {
+	var networks []string
+	seen := make(map[string]bool)
+	for _, rule := range s.Rules {
+		for _, name := range []string{rule.Source, rule.Destination} {
+			if name == "" || name == "any" {
+				continue
+			}
+			fqn := strings.Join(NetworkFQName(tenant, name), ":")
+			if !seen[fqn] {
+				seen[fqn] = true
+				networks = append(networks, fqn)
+			}
+		}
+	}
+	return networks
+}
+
+func (r *NetworkPolicyRule) policyRule(tenant string) (*types.PolicyRuleType, error) {
+	protocol, err := parseProtocol(r.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	srcPorts, err := parsePortRange(r.SourcePorts)
+	if err != nil {
+		return nil, err
+	}
+	dstPorts, err := parsePortRange(r.DestinationPorts)
+	if err != nil {
+		return nil, err
+	}
+	if r.Source == "" || r.Destination == "" {
+		return nil, fmt.Errorf("rule without a source or a destination network")
+	}
+	address := func(name string) types.AddressType {
+		if name == "any" {
+			return types.AddressType{VirtualNetwork: "any"}
+		}
+		return types.AddressType{VirtualNetwork: strings.Join(NetworkFQName(tenant, name), ":")}
+	}
+
+	action := ""
+	switch r.Action {
+	case "", "allow":
+		action = "pass"
+	case "deny":
+		action = "deny"
+	default:
+		return nil, fmt.Errorf("invalid action %q", r.Action)
+	}
+	direction := ">"
+	if r.Bidirectional {
+		direction = "<>"
+	}
+	return &types.PolicyRuleType{
+		Direction:    direction,
+		Protocol:     protocol,
+		SrcAddresses: []types.AddressType{address(r.Source)},
+		SrcPorts:     []types.PortType{srcPorts},
+		DstAddresses: []types.AddressType{address(r.Destination)},
+		DstPorts:     []types.PortType{dstPorts},
+		ActionList:   &types.ActionListType{SimpleAction: action},
+	}, nil
+}
+
+// LocateNetworkPolicy creates the network policy of spec, or replaces the
+// rules of an existing policy with those of spec.
+func (m *NetworkPolicyManagerImpl) LocateNetworkPolicy(tenant string, spec *NetworkPolicySpec) (*types.NetworkPolicy, error) {
+	if spec.Name == "" {
+		return nil, fmt.Errorf("network policy without a name")
+	}
+	entries := &types.PolicyEntriesType{}
+	for i := range spec.Rules {
+		rule, err := spec.Rules[i].policyRule(tenant)
+		if err != nil {
+			return nil, fmt.Errorf("network policy %s rule %d: %v", spec.Name, i+1, err)
+		}
+		entries.PolicyRule = append(entries.PolicyRule, *rule)
+	}
+
+	fqn := []string{domain, tenant, spec.Name}
+	policy, err := types.NetworkPolicyByName(m.client, strings.Join(fqn, ":"))
+	if err == nil {
+		policy.SetNetworkPolicyEntries(entries)
+		if err := m.client.Update(policy); err != nil {
+			return nil, fmt.Errorf("update network policy %s: %v", spec.Name, err)
+		}
+		return policy, nil
+	} else if !isNotFound(err) {
+		return nil, err
+	}
+
+	policy = new(types.NetworkPolicy)
+	policy.SetFQName("project", fqn)
+	policy.SetNetworkPolicyEntries(entries)
+	if err := m.client.Create(policy); err != nil {
+		return nil, fmt.Errorf("create network policy %s: %v", spec.Name, err)
+	}
+	log.Info("Created network policy %s", strings.Join(fqn, ":"))
+	return policy, nil
+}
+
+// AttachNetworkPolicy makes networks, given by fully qualified name, the
+// networks the policy is applied to: it is attached to each of them and
+// detached from any other network. It returns the names of the networks that
+// were updated.
+func (m *NetworkPolicyManagerImpl) AttachNetworkPolicy(policy *types.NetworkPolicy, networks []string) ([]string, error) {
+	var updated []string
+	wanted := make(map[string]bool)
+	for _, fqn := range networks {
+		wanted[fqn] = true
+		vn, err := types.VirtualNetworkByName(m.client, fqn)
+		if err != nil {
+			return updated, fmt.Errorf("network %s: %v", fqn, err)
+		}
+		refs, err := vn.GetNetworkPolicyRefs()
+		if err != nil {
+			return updated, err
+		}
+		attached := false
+		for _, ref := range refs {
+			if ref.Uuid == policy.GetUuid() {
+				attached = true
+				break
+			}
+		}
+		if attached {
+			continue
+		}
+		err = vn.AddNetworkPolicy(policy, types.VirtualNetworkPolicyType{
+			Sequence: &types.SequenceType{Major: 0, Minor: 0},
+		})
+		if err != nil {
+			return updated, err
+		}
+		if err := m.client.Update(vn); err != nil {
+			return updated, fmt.Errorf("update network %s: %v", fqn, err)
+		}
+		updated = append(updated, fqn)
+	}
+
+	refs, err := policy.GetVirtualNetworkBackRefs()
+	if err != nil {
+		return updated, err
+	}
+	for _, ref := range refs {
+		fqn := strings.Join(ref.To, ":")
+		if wanted[fqn] {
+			continue
+		}
+		vn, err := types.VirtualNetworkByUuid(m.client, ref.Uuid)
+		if err != nil {
+			return updated, fmt.Errorf("network %s: %v", fqn, err)
+		}
+		if err := vn.DeleteNetworkPolicy(policy.GetUuid()); err != nil {
+			return updated, err
+		}
+		if err := m.client.Update(vn); err != nil {
+			return updated, fmt.Errorf("update network %s: %v", fqn, err)
+		}
+		updated = append(updated, fqn)
+	}
+	return updated, nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Juniper/contrail-go-api/types"
+)
+
+// Repair re-creates the objects of a previously built instance that are
+// missing. The virtual-machine and virtual-machine-interface keep the uuids
+// recorded in mdata and the interface keeps its mac address, so that the
+// vrouter port and the container configuration remain valid. The instance-ips
+// are created with the recorded addresses and, when the interface has no
+// floating-ip, a non-empty floatingIp of pool is associated with it again. It
+// returns a description of each object that was re-created.
+func (m *NetworkManagerImpl) Repair(tenant, networkName, instanceName string, index int, mdata *InstanceMetadata, pool, floatingIp string) ([]string, error) {
+	var repaired []string
+	network, err := m.LocateNetwork(tenant, networkName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to lookup or create network %s: %v", networkName, err)
+	}
+
+	fqn := instanceFQName(tenant, instanceName)
+	fqnStr := strings.Join(fqn, ":")
+	instance, err := types.VirtualMachineByName(m.client, fqnStr)
+	if isNotFound(err) {
+		instance = new(types.VirtualMachine)
+		instance.SetFQName("project", fqn)
+		instance.SetUuid(mdata.InstanceId)
+		setManaged(instance)
+		if err := m.client.Create(instance); err != nil {
+			return repaired, fmt.Errorf("unable to create instance %s: %v", fqnStr, err)
+		}
+		repaired = append(repaired, "virtual-machine "+fqnStr)
+	} else if err != nil {
+		return repaired, err
+	}
+
+	nicFQN := interfaceFQName(tenant, InterfaceName(instanceName, index))
+	nicFQNStr := strings.Join(nicFQN, ":")
+	nic, err := types.VirtualMachineInterfaceByName(m.client, nicFQNStr)
+	if isNotFound(err) {
+		nic = new(types.VirtualMachineInterface)
+		nic.SetFQName("project", nicFQN)
+		nic.SetUuid(mdata.NicId)
+		nic.AddVirtualMachine(instance)
+		nic.AddVirtualNetwork(network)
+		nic.SetVirtualMachineInterfaceMacAddresses(&types.MacAddressesType{
+			MacAddress: []string{mdata.MacAddress},
+		})
+		if err := m.client.Create(nic); err != nil {
+			return repaired, fmt.Errorf("unable to create interface %s: %v", nicFQNStr, err)
+		}
+		repaired = append(repaired, "virtual-machine-interface "+nicFQNStr)
+	} else if err != nil {
+		return repaired, err
+	} else if nic.GetUuid() != mdata.NicId {
+		return repaired, fmt.Errorf("interface %s has uuid %s, expected %s", nicFQNStr, nic.GetUuid(), mdata.NicId)
+	}
+
+	addresses := map[string]string{FamilyV4: mdata.IpAddress, FamilyV6: mdata.IpAddress6}
+	for _, family := range []string{FamilyV4, FamilyV6} {
+		recorded := addresses[family]
+		ipName := makeFamilyInstanceIpName(tenant, nic.GetName(), family)
+		if recorded == "" || m.exists("instance-ip", ipName) {
+			continue
+		}
+		if err := m.allocator.ReserveIpAddress(nic.GetUuid(), family, recorded); err != nil {
+			return repaired, fmt.Errorf("unable to reserve %s: %v", recorded, err)
+		}
+		_, err = m.instanceMgr.LocateInstanceIpWithAddress(network, nic, family, recorded)
+		if err != nil {
+			return repaired, fmt.Errorf("unable to create instance-ip %s: %v", ipName, err)
+		}
+		repaired = append(repaired, "instance-ip "+ipName)
+	}
+
+	if floatingIp != "" {
+		refs, err := nic.GetFloatingIpBackRefs()
+		if err != nil {
+			return repaired, fmt.Errorf("unable to get floating-ips of %s: %v", nicFQNStr, err)
+		}
+		if len(refs) > 0 {
+			return repaired, nil
+		}
+		if pool == "" {
+			return repaired, fmt.Errorf("unable to associate floating-ip %s with %s: no floating-ip-pool recorded", floatingIp, nicFQNStr)
+		}
+		tx := NewTransaction()
+		if _, err := m.AssociateFloatingIp(tx, tenant, instanceName, index, pool, floatingIp); err != nil {
+			return repaired, tx.Fail("floating-ip "+floatingIp, err)
+		}
+		repaired = append(repaired, "floating-ip "+floatingIp)
+	}
+	return repaired, nil
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Juniper/contrail-go-api"
+	"github.com/Juniper/contrail-go-api/types"
+)
+
+// SecurityGroupRule allows traffic in one direction between the interfaces of
+// the group and either a prefix or the members of another group.
+type SecurityGroupRule struct {
+	Direction string `yaml:"direction"` // ingress or egress
+	Protocol  string `yaml:"protocol"`  // any (default), tcp, udp, icmp, icmp6 or a number
+	Ports     string `yaml:"ports"`     // "80" or "8000-8080"; any when empty
+	// At most one of RemotePrefix and RemoteGroup; any IPv4 address when
+	// neither is set.
+	RemotePrefix string `yaml:"remote_prefix"`
+	RemoteGroup  string `yaml:"remote_group"`
+}
+
+// SecurityGroupSpec is the declarative definition of a security group in the
+// tenant project.
+type SecurityGroupSpec struct {
+	Name  string              `yaml:"name"`
+	Rules []SecurityGroupRule `yaml:"rules"`
+}
+
+// SecurityGroupFile is the format of a security group definition file.
+type SecurityGroupFile struct {
+	SecurityGroups []SecurityGroupSpec `yaml:"security_groups"`
+}
+
+type SecurityGroupManager interface {
+	LocateSecurityGroup(tenant string, spec *SecurityGroupSpec) (*types.SecurityGroup, error)
+	SetInterfaceSecurityGroups(tenant, nicName string, groups []string) (bool, error)
+}
+
+type SecurityGroupManagerImpl struct {
+	client contrail.ApiClient
+}
+
+func NewSecurityGroupManager(client contrail.ApiClient) SecurityGroupManager {
+	return &SecurityGroupManagerImpl{client: client}
+}
+
+func securityGroupFQName(tenant, name string) []string {
+	return []string{domain, tenant, name}
+}
+
+// policyRule converts a rule into the OpenContrail representation, where the
+// group itself is the "local" address.
+func (r *SecurityGroupRule) policyRule(tenant string) (*types.PolicyRuleType, error) {
+	protocol, err := parseProtocol(r.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := parsePortRange(r.Ports)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := types.AddressType{}
+	ethertype := "IPv4"
+	switch {
+	case r.RemotePrefix != "" && r.RemoteGroup != "":
+		return nil, fmt.Errorf("rule has both remote_prefix and remote_group")
+	case r.RemoteGroup != "":
+		remote.SecurityGroup = strings.Join(securityGroupFQName(tenant, r.RemoteGroup), ":")
+	default:
+		prefix := r.RemotePrefix
+		if prefix == "" {
+			prefix = "0.0.0.0/0"
+		}
+		remote.Subnet, ethertype, err = parsePrefix(prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	local := types.AddressType{SecurityGroup: "local"}
+	anyPort := types.PortType{StartPort: 0, EndPort: 65535}
+
+	rule := &types.PolicyRuleType{
+		Direction: ">",
+		Protocol:  protocol,
+		Ethertype: ethertype,
+	}
+	switch r.Direction {
+	case "ingress":
+		rule.SrcAddresses = []types.AddressType{remote}
+		rule.SrcPorts = []types.PortType{anyPort}
+		rule.DstAddresses = []types.AddressType{local}
+		rule.DstPorts = []types.PortType{ports}
+	case "egress":
+		rule.SrcAddresses = []types.AddressType{local}
+		rule.SrcPorts = []types.PortType{anyPort}
+		rule.DstAddresses = []types.AddressType{remote}
+		rule.DstPorts = []types.PortType{ports}
+	default:
+		return nil, fmt.Errorf("invalid direction %q", r.Direction)
+	}
+	return rule, nil
+}
+
+// LocateSecurityGroup creates the security group of spec, or replaces the
+// rules of an existing group with those of spec.
+func (m *SecurityGroupManagerImpl) LocateSecurityGroup(tenant string, spec *SecurityGroupSpec) (*types.SecurityGroup, error) {
+	if spec.Name == "" {
+		return nil, fmt.Errorf("security group without a name")
+	}
+	entries := &types.PolicyEntriesType{}
+	for i := range spec.Rules {
+		rule, err := spec.Rules[i].policyRule(tenant)
+		if err != nil {
+			return nil, fmt.Errorf("security group %s rule %d: %v", spec.Name, i+1, err)
+		}
+		entries.PolicyRule = append(entries.PolicyRule, *rule)
+	}
+
+	fqn := securityGroupFQName(tenant, spec.Name)
+	group, err := types.SecurityGroupByName(m.client, strings.Join(fqn, ":"))
+	if err == nil {
+		group.SetSecurityGroupEntries(entries)
+		if err := m.client.Update(group); err != nil {
+			return nil, fmt.Errorf("update security group %s: %v", spec.Name, err)
+		}
+		return group, nil
+	} else if !isNotFound(err) {
+		return nil, err
+	}
+
+	group = new(types.SecurityGroup)
+	group.SetFQName("project", fqn)
+	group.SetSecurityGroupEntries(entries)
+	if err := m.client.Create(group); err != nil {
+		return nil, fmt.Errorf("create security group %s: %v", spec.Name, err)
+	}
+	log.Info("Created security group %s", strings.Join(fqn, ":"))
+	return group, nil
+}
+
+// SetInterfaceSecurityGroups makes groups, which must exist in the tenant
+// project, the security groups of the interface. It reports whether the
+// interface was updated.
+func (m *SecurityGroupManagerImpl) SetInterfaceSecurityGroups(tenant, nicName string, groups []string) (bool, error) {
+	fqn := strings.Join(interfaceFQName(tenant, nicName), ":")
+	nic, err := types.VirtualMachineInterfaceByName(m.client, fqn)
+	if err != nil {
+		return false, fmt.Errorf("interface %s: %v", fqn, err)
+	}
+
+	refs, err := nic.GetSecurityGroupRefs()
+	if err != nil {
+		return false, err
+	}
+	var current, wanted []string
+	for _, ref := range refs {
+		current = append(current, strings.Join(ref.To, ":"))
+	}
+	for _, name := range groups {
+		wanted = append(wanted, strings.Join(securityGroupFQName(tenant, name), ":"))
+	}
+	sort.Strings(current)
+	sort.Strings(wanted)
+	if strings.Join(current, ",") == strings.Join(wanted, ",") {
+		return false, nil
+	}
+
+	nic.ClearSecurityGroup()
+	for _, name := range wanted {
+		group, err := types.SecurityGroupByName(m.client, name)
+		if err != nil {
+			return false, fmt.Errorf("security group %s: %v", name, err)
+		}
+		if err := nic.AddSecurityGroup(group); err != nil {
+			return false, err
+		}
+	}
+	if err := m.client.Update(nic); err != nil {
+		return false, fmt.Errorf("update interface %s: %v", fqn, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Juniper/contrail-go-api/types"
+	"gopkg.in/yaml.v2"
+)
+
+// LoadSpec reads a YAML or JSON declarative spec from path into v.
+func LoadSpec(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, v); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// parsePortRange parses "80" or "8000-8080". An empty range is any port.
+func parsePortRange(ports string) (types.PortType, error) {
+	if ports == "" || ports == "any" {
+		return types.PortType{StartPort: 0, EndPort: 65535}, nil
+	}
+	bounds := strings.SplitN(ports, "-", 2)
+	start, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return types.PortType{}, fmt.Errorf("invalid port range %q", ports)
+	}
+	end := start
+	if len(bounds) == 2 {
+		end, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return types.PortType{}, fmt.Errorf("invalid port range %q", ports)
+		}
+	}
+	if start < 0 || end > 65535 || start > end {
+		return types.PortType{}, fmt.Errorf("invalid port range %q", ports)
+	}
+	return types.PortType{StartPort: start, EndPort: end}, nil
+}
+
+// parseProtocol validates a rule protocol: any, tcp, udp, icmp, icmp6 or an
+// IP protocol number.
+func parseProtocol(protocol string) (string, error) {
+	switch protocol {
+	case "":
+		return "any", nil
+	case "any", "tcp", "udp", "icmp", "icmp6":
+		return protocol, nil
+	}
+	if n, err := strconv.Atoi(protocol); err == nil && n >= 0 && n <= 255 {
+		return protocol, nil
+	}
+	return "", fmt.Errorf("invalid protocol %q", protocol)
+}
+
+// parsePrefix converts a prefix in CIDR notation to a SubnetType and returns
+// its ethertype.
+func parsePrefix(prefix string) (*types.SubnetType, string, error) {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	plen, _ := ipnet.Mask.Size()
+	ethertype := "IPv4"
+	if ipnet.IP.To4() == nil {
+		ethertype = "IPv6"
+	}
+	return &types.SubnetType{IpPrefix: ipnet.IP.String(), IpPrefixLen: plen}, ethertype, nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Juniper/contrail-go-api"
+	"github.com/Juniper/contrail-go-api/types"
+)
+
+// Address families, as used in the instance_ip_family of an instance-ip.
+const (
+	FamilyV4 = "v4"
+	FamilyV6 = "v6"
+)
+
+const (
+	DefaultNetworkIpam = "default-domain:default-project:default-network-ipam"
+)
+
+// SplitSubnets parses a comma separated list of prefixes, with at most one
+// prefix per address family.
+func SplitSubnets(subnets string) ([]string, error) {
+	var prefixes []string
+	seen := make(map[string]bool)
+	for _, prefix := range strings.Split(subnets, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		family, err := prefixFamily(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if seen[family] {
+			return nil, fmt.Errorf("more than one %s prefix in %s", family, subnets)
+		}
+		seen[family] = true
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// prefixFamily returns the address family of a prefix in CIDR notation.
+func prefixFamily(prefix string) (string, error) {
+	ip, _, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return "", err
+	}
+	if ip.To4() != nil {
+		return FamilyV4, nil
+	}
+	return FamilyV6, nil
+}
+
+// createNetworkWithSubnets is config.CreateNetworkWithSubnet for a list of
+// prefixes of either address family.
+func createNetworkWithSubnets(client contrail.ApiClient, projectId, name string, prefixes []string) (string, error) {
+	project, err := types.ProjectByUuid(client, projectId)
+	if err != nil {
+		return "", err
+	}
+	ipam, err := types.NetworkIpamByName(client, DefaultNetworkIpam)
+	if err != nil {
+		return "", err
+	}
+
+	subnets := types.VnSubnetsType{}
+	for _, prefix := range prefixes {
+		_, ipnet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return "", err
+		}
+		plen, _ := ipnet.Mask.Size()
+		subnets.IpamSubnets = append(subnets.IpamSubnets, types.IpamSubnetType{
+			Subnet: &types.SubnetType{IpPrefix: ipnet.IP.String(), IpPrefixLen: plen},
+		})
+	}
+
+	vn := new(types.VirtualNetwork)
+	vn.SetParent(project)
+	vn.SetName(name)
+	vn.AddNetworkIpam(ipam, subnets)
+	if err := client.Create(vn); err != nil {
+		return "", err
+	}
+	return vn.GetUuid(), nil
+}
+
+// findIpamSubnet returns the first subnet of the network in the given address
+// family.
+func findIpamSubnet(network *types.VirtualNetwork, family string) (*types.IpamSubnetType, error) {
+	refs, err := network.GetNetworkIpamRefs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve network-ipam refs")
+	}
+	for _, ref := range refs {
+		attr := ref.Attr.(types.VnSubnetsType)
+		for i := range attr.IpamSubnets {
+			subnet := attr.IpamSubnets[i].Subnet
+			if subnet == nil {
+				continue
+			}
+			ip := net.ParseIP(subnet.IpPrefix)
+			if ip == nil {
+				continue
+			}
+			if (ip.To4() != nil) == (family == FamilyV4) {
+				return &attr.IpamSubnets[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("network %s has no %s subnet", network.GetName(), family)
+}
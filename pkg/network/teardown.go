@@ -0,0 +1,201 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Juniper/contrail-go-api/types"
+)
+
+// TeardownReport lists the objects that Teardown deleted and the ones that
+// were already absent. Entries have the form "<type> <name or uuid>".
+type TeardownReport struct {
+	Removed []string
+	Absent  []string
+}
+
+func (r *TeardownReport) removed(typename, id string) {
+	r.Removed = append(r.Removed, typename+" "+id)
+}
+
+func (r *TeardownReport) absent(typename, id string) {
+	r.Absent = append(r.Absent, typename+" "+id)
+}
+
+func (r *TeardownReport) String() string {
+	return fmt.Sprintf("removed: [%s] absent: [%s]",
+		strings.Join(r.Removed, ", "), strings.Join(r.Absent, ", "))
+}
+
+// Teardown deletes the objects created by Build in dependency order:
+// floating-ips, instance-ip and virtual-machine-interface of each interface,
+// the virtual-machine and finally the allocator addresses. Objects that no
+// longer exist are recorded as absent, so that Teardown can be used to clean
+// up a partial setup. A non-empty networkName restricts the teardown to the
+// interfaces on that network; the virtual-machine is then kept while it has
+// interfaces on other networks.
+func (m *NetworkManagerImpl) Teardown(tenant, networkName, instanceName string) (*TeardownReport, error) {
+	report := new(TeardownReport)
+	fqn := strings.Join(instanceFQName(tenant, instanceName), ":")
+
+	instance, err := types.VirtualMachineByName(m.client, fqn)
+	if err != nil && !isNotFound(err) {
+		return report, fmt.Errorf("unable to lookup instance %s: %v", fqn, err)
+	}
+
+	var nicIds []string
+	if err == nil {
+		refs, err := instance.GetVirtualMachineInterfaceBackRefs()
+		if err != nil {
+			return report, fmt.Errorf("unable to get interfaces of %s: %v", fqn, err)
+		}
+		for _, ref := range refs {
+			nicIds = append(nicIds, ref.Uuid)
+		}
+	} else {
+		// Without the virtual-machine, only the first interface can be
+		// found by name.
+		report.absent("virtual-machine", fqn)
+		nicId, err := m.client.UuidByName("virtual-machine-interface", fqn)
+		if err == nil {
+			nicIds = append(nicIds, nicId)
+		} else if !isNotFound(err) {
+			return report, fmt.Errorf("unable to lookup interface %s: %v", fqn, err)
+		}
+	}
+	keepInstance := false
+	if networkName != "" {
+		networkFQN := strings.Join([]string{domain, tenant, networkName}, ":")
+		var scoped []string
+		for _, nicId := range nicIds {
+			onNetwork, err := m.onNetwork(nicId, networkFQN)
+			if err != nil {
+				return report, err
+			}
+			if onNetwork {
+				scoped = append(scoped, nicId)
+			} else {
+				keepInstance = true
+			}
+		}
+		nicIds = scoped
+	}
+	if len(nicIds) == 0 {
+		report.absent("virtual-machine-interface", fqn)
+	}
+
+	for _, nicId := range nicIds {
+		if err := m.teardownInterface(report, nicId); err != nil {
+			return report, err
+		}
+	}
+
+	if instance != nil && !keepInstance {
+		if err := m.deleteObject(report, "virtual-machine", instance.GetUuid()); err != nil {
+			return report, fmt.Errorf("unable to delete instance %s: %v", fqn, err)
+		}
+	}
+
+	for _, nicId := range nicIds {
+		released, err := m.allocator.ReleaseIpAddress(nicId)
+		if err != nil {
+			return report, fmt.Errorf("unable to release address of %s: %v", nicId, err)
+		}
+		if released {
+			report.removed("address", nicId)
+		} else {
+			report.absent("address", nicId)
+		}
+	}
+
+	log.Info("Teardown %s: %s", instanceName, report)
+	return report, nil
+}
+
+// onNetwork reports whether the interface nicId is attached to the network
+// networkFQN. An interface that no longer exists is reported as attached, so
+// that it is recorded as absent by the teardown.
+func (m *NetworkManagerImpl) onNetwork(nicId, networkFQN string) (bool, error) {
+	nic, err := types.VirtualMachineInterfaceByUuid(m.client, nicId)
+	if isNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to lookup interface %s: %v", nicId, err)
+	}
+	refs, err := nic.GetVirtualNetworkRefs()
+	if err != nil {
+		return false, fmt.Errorf("unable to get network of %s: %v", nicId, err)
+	}
+	for _, ref := range refs {
+		if strings.Join(ref.To, ":") == networkFQN {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *NetworkManagerImpl) teardownInterface(report *TeardownReport, nicId string) error {
+	nic, err := types.VirtualMachineInterfaceByUuid(m.client, nicId)
+	if err != nil {
+		if isNotFound(err) {
+			report.absent("virtual-machine-interface", nicId)
+			return nil
+		}
+		return fmt.Errorf("unable to lookup interface %s: %v", nicId, err)
+	}
+
+	refs, err := nic.GetFloatingIpBackRefs()
+	if err != nil {
+		return fmt.Errorf("unable to get floating-ips of %s: %v", nicId, err)
+	}
+	for _, ref := range refs {
+		if err := m.deleteObject(report, "floating-ip", ref.Uuid); err != nil {
+			return err
+		}
+	}
+
+	refs, err = nic.GetInstanceIpBackRefs()
+	if err != nil {
+		return fmt.Errorf("unable to get instance-ips of %s: %v", nicId, err)
+	}
+	if len(refs) == 0 {
+		report.absent("instance-ip", makeInstanceIpName(nic.GetFQName()[1], nic.GetName()))
+	}
+	for _, ref := range refs {
+		if err := m.deleteObject(report, "instance-ip", ref.Uuid); err != nil {
+			return err
+		}
+	}
+
+	return m.deleteObject(report, "virtual-machine-interface", nicId)
+}
+
+func (m *NetworkManagerImpl) deleteObject(report *TeardownReport, typename, uuid string) error {
+	err := m.client.DeleteByUuid(typename, uuid)
+	if err == nil {
+		report.removed(typename, uuid)
+		return nil
+	}
+	if isNotFound(err) {
+		report.absent(typename, uuid)
+		return nil
+	}
+	log.Error("Delete %s %s: %v", typename, uuid, err)
+	return err
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"strings"
+)
+
+type transactionStep struct {
+	name string
+	undo func() error
+}
+
+// Transaction records the provisioning steps that have completed, so that
+// they can be undone in reverse order when a later step fails.
+type Transaction struct {
+	steps []transactionStep
+}
+
+func NewTransaction() *Transaction {
+	return new(Transaction)
+}
+
+// Add records a completed step and the function that reverts it.
+func (t *Transaction) Add(name string, undo func() error) {
+	t.steps = append(t.steps, transactionStep{name: name, undo: undo})
+}
+
+// Rollback undoes all the recorded steps, most recent first. It continues
+// past failures and returns an error listing the steps that could not be
+// undone.
+func (t *Transaction) Rollback() error {
+	var failed []string
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		step := t.steps[i]
+		if err := step.undo(); err != nil {
+			log.Error("Rollback %s: %v", step.name, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", step.name, err))
+			continue
+		}
+		log.Debug("Rolled back %s", step.name)
+	}
+	t.steps = nil
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Fail rolls back the transaction and returns an error that names the step
+// that failed along with the result of the rollback.
+func (t *Transaction) Fail(step string, err error) error {
+	return &TransactionError{Step: step, Err: err, RollbackErr: t.Rollback()}
+}
+
+type TransactionError struct {
+	Step        string
+	Err         error
+	RollbackErr error
+}
+
+func (e *TransactionError) Error() string {
+	rollback := "rolled back"
+	if e.RollbackErr != nil {
+		rollback = "rollback failed: " + e.RollbackErr.Error()
+	}
+	return fmt.Sprintf("%s: %v (%s)", e.Step, e.Err, rollback)
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package state keeps a local record of the endpoints provisioned by packnet.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pedro-r-marques/packnet/pkg/network"
+)
+
+const (
+	DefaultDir = "/var/lib/packnet"
+)
+
+// Provisioning stages, in the order in which they are reached.
+const (
+	StageBuilt     = "built"     // OpenContrail objects created
+	StageInterface = "interface" // veth pair created and configured
+	StageComplete  = "complete"  // vrouter port added
+)
+
+var ErrNotFound = errors.New("endpoint not found")
+
+// Endpoint is the record of a container connected by packnet.
+type Endpoint struct {
+	Id         string
+	Tenant     string
+	Interfaces []*Interface
+	// Security groups of the interfaces; nil when not managed by packnet.
+	SecurityGroups []string
+	NetnsType      string
+	Netns          string
+	Stage          string
+	Updated        time.Time
+}
+
+// Interface is the record of one of the interfaces of a container. Its
+// position in Endpoint.Interfaces is the interface index.
+type Interface struct {
+	Network      string
+	Name         string
+	VethName     string
+	DefaultRoute bool
+	Metadata     network.InstanceMetadata
+	// Floating address associated with the interface, if any, and the
+	// floating-ip-pool it belongs to.
+	FloatingIp     string
+	FloatingIpPool string
+}
+
+// Config returns the configuration of the index-th interface of the container.
+func (i *Interface) Config(index int) *network.InterfaceConfig {
+	return &network.InterfaceConfig{
+		Index:        index,
+		Name:         i.Name,
+		MacAddress:   i.Metadata.MacAddress,
+		IpAddress:    i.Metadata.IpAddress,
+		Gateway:      i.Metadata.Gateway,
+		Subnet:       i.Metadata.Subnet,
+		IpAddress6:   i.Metadata.IpAddress6,
+		Gateway6:     i.Metadata.Gateway6,
+		Subnet6:      i.Metadata.Subnet6,
+		DefaultRoute: i.DefaultRoute,
+	}
+}
+
+type Store interface {
+	Get(id string) (*Endpoint, error)
+	Put(endpoint *Endpoint) error
+	// Update runs fn on the record of id and saves the record unless fn
+	// fails. The record is locked meanwhile, so that concurrent updates,
+	// from this or other processes, are not lost. It returns ErrNotFound
+	// when there is no record.
+	Update(id string, fn func(*Endpoint) error) error
+	Delete(id string) error
+	List() ([]*Endpoint, error)
+}
+
+// FileStore keeps one JSON file per endpoint. Files are replaced with a
+// rename so that readers never observe a partial record; writers hold an
+// flock on a per-endpoint lock file.
+type FileStore struct {
+	dir string
+}
+
+func NewStore(dir string) (Store, error) {
+	s := &FileStore{dir: filepath.Join(dir, "endpoints")}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *FileStore) Get(id string) (*Endpoint, error) {
+	data, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	endpoint := new(Endpoint)
+	if err := json.Unmarshal(data, endpoint); err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+// lock takes the lock of the record of id and returns the function that
+// releases it.
+func (s *FileStore) lock(id string) (func(), error) {
+	path := filepath.Join(s.dir, id+".lock")
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("lock %s: %v", path, err)
+		}
+		// Delete removes the lock file with the lock held: retry when the
+		// file that was locked is no longer the one at path.
+		held, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(held, current) {
+			return func() {
+				syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+				f.Close()
+			}, nil
+		}
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+func (s *FileStore) Put(endpoint *Endpoint) error {
+	unlock, err := s.lock(endpoint.Id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.put(endpoint)
+}
+
+func (s *FileStore) Update(id string, fn func(*Endpoint) error) error {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	endpoint, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := fn(endpoint); err != nil {
+		return err
+	}
+	return s.put(endpoint)
+}
+
+func (s *FileStore) put(endpoint *Endpoint) error {
+	endpoint.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(endpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(s.dir, endpoint.Id+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if cerr := tmpFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), s.path(endpoint.Id))
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+func (s *FileStore) Delete(id string) error {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(s.path(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(filepath.Join(s.dir, id+".lock"))
+}
+
+func (s *FileStore) List() ([]*Endpoint, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []*Endpoint
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		endpoint, err := s.Get(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
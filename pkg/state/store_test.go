@@ -0,0 +1,86 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentUpdate runs updates through separate stores, as separate
+// packnet processes would, and checks that none of them is lost.
+func TestConcurrentUpdate(t *testing.T) {
+	const (
+		id       = "0123456789"
+		writers  = 8
+		perStore = 10
+	)
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(id, func(*Endpoint) error { return nil }); err != ErrNotFound {
+		t.Errorf("update of a missing record: %v, expected ErrNotFound", err)
+	}
+	if err := store.Put(&Endpoint{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := NewStore(dir)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for j := 0; j < perStore; j++ {
+				err := s.Update(id, func(endpoint *Endpoint) error {
+					endpoint.Interfaces = append(endpoint.Interfaces, &Interface{})
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	endpoint, err := store.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoint.Interfaces) != writers*perStore {
+		t.Errorf("%d updates recorded, expected %d", len(endpoint.Interfaces), writers*perStore)
+	}
+
+	if err := store.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir + "/endpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		t.Errorf("%s left after the delete", file.Name())
+	}
+}
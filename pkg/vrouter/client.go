@@ -0,0 +1,158 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vrouter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultAgentPort = 9091
+
+	// Port types understood by the agent.
+	PortTypeVM = 0
+)
+
+// Port is the representation of a virtual-machine-interface used by the
+// vrouter agent port IPC interface.
+type Port struct {
+	Id          string `json:"id"`
+	InstanceId  string `json:"instance-id"`
+	DisplayName string `json:"display-name"`
+	IpAddress   string `json:"ip-address"`
+	Ip6Address  string `json:"ip6-address"`
+	VnId        string `json:"vn-id"`
+	VmProjectId string `json:"vm-project-id"`
+	MacAddress  string `json:"mac-address"`
+	SystemName  string `json:"system-name"`
+	Type        int    `json:"type"`
+	RxVlanId    int    `json:"rx-vlan-id"`
+	TxVlanId    int    `json:"tx-vlan-id"`
+	Author      string `json:"author"`
+	Time        string `json:"time"`
+}
+
+// PortError is returned when the agent cannot be reached or rejects a request.
+type PortError struct {
+	Op         string
+	PortId     string
+	StatusCode int
+	Message    string
+	Err        error
+}
+
+func (e *PortError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("vrouter %s %s: %v", e.Op, e.PortId, e.Err)
+	}
+	return fmt.Sprintf("vrouter %s %s: %d %s", e.Op, e.PortId, e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err indicates that the port is not known to the agent.
+func IsNotFound(err error) bool {
+	e, ok := err.(*PortError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+type PortClient interface {
+	AddPort(port *Port) error
+	DeletePort(portId string) error
+	ListPorts() ([]Port, error)
+}
+
+type PortClientImpl struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewPortClient(server string, port int) PortClient {
+	c := &PortClientImpl{
+		baseURL: fmt.Sprintf("http://%s:%d/port", server, port),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	return c
+}
+
+func (c *PortClientImpl) do(op, portId, method, url string, body interface{}) ([]byte, error) {
+	var content []byte
+	if body != nil {
+		var err error
+		content, err = json.Marshal(body)
+		if err != nil {
+			return nil, &PortError{Op: op, PortId: portId, Err: err}
+		}
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(content))
+	if err != nil {
+		return nil, &PortError{Op: op, PortId: portId, Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, &PortError{Op: op, PortId: portId, Err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &PortError{Op: op, PortId: portId, Err: err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &PortError{
+			Op:         op,
+			PortId:     portId,
+			StatusCode: resp.StatusCode,
+			Message:    string(bytes.TrimSpace(data)),
+		}
+	}
+	return data, nil
+}
+
+func (c *PortClientImpl) AddPort(port *Port) error {
+	if port.Time == "" {
+		port.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	if port.Author == "" {
+		port.Author = "packnet"
+	}
+	_, err := c.do("add", port.Id, "POST", c.baseURL, port)
+	return err
+}
+
+func (c *PortClientImpl) DeletePort(portId string) error {
+	_, err := c.do("delete", portId, "DELETE", c.baseURL+"/"+portId, nil)
+	return err
+}
+
+func (c *PortClientImpl) ListPorts() ([]Port, error) {
+	data, err := c.do("list", "", "GET", c.baseURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	var ports []Port
+	if err := json.Unmarshal(data, &ports); err != nil {
+		return nil, &PortError{Op: "list", Err: err}
+	}
+	return ports, nil
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pedro-r-marques/packnet/pkg/network"
+)
+
+// Policies creates the network policies of --policy-file in the tenant project
+// and attaches each of them to the networks its rules reference. Networks of
+// the tenant project are created when they do not exist yet.
+func Policies(c *Config, out io.Writer) error {
+	if c.PolicyFile == "" {
+		return fmt.Errorf("no policy file specified")
+	}
+	var file network.NetworkPolicyFile
+	if err := network.LoadSpec(c.PolicyFile, &file); err != nil {
+		return err
+	}
+
+	manager, err := newNetworkManager(c)
+	if err != nil {
+		return err
+	}
+	client, err := newApiClient(c)
+	if err != nil {
+		return err
+	}
+	policyManager := network.NewNetworkPolicyManager(client)
+	for i := range file.NetworkPolicies {
+		spec := &file.NetworkPolicies[i]
+		networks := spec.Networks(c.Tenant)
+		for _, fqn := range networks {
+			name := strings.Split(fqn, ":")
+			if len(name) == 3 && name[0] == network.Domain() && name[1] == c.Tenant {
+				if _, err := manager.LocateNetwork(c.Tenant, name[2]); err != nil {
+					return err
+				}
+			}
+		}
+		policy, err := policyManager.LocateNetworkPolicy(c.Tenant, spec)
+		if err != nil {
+			return err
+		}
+		updated, err := policyManager.AttachNetworkPolicy(policy, networks)
+		for _, fqn := range updated {
+			fmt.Fprintf(out, "updated virtual-network %s (network-policy %s)\n", fqn, spec.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("network policy %s: %v", spec.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pedro-r-marques/packnet/pkg/network"
+	"github.com/pedro-r-marques/packnet/pkg/state"
+	"github.com/pedro-r-marques/packnet/pkg/vrouter"
+)
+
+// Reconcile compares the local state of each connected container with the
+// OpenContrail configuration, the vrouter ports and the container network
+// namespace, and re-creates what is missing. With a non-zero interval it runs
+// periodically.
+func Reconcile(c *Config, interval time.Duration, out io.Writer) error {
+	for {
+		err := reconcileOnce(c, out)
+		if interval == 0 {
+			return err
+		}
+		if err != nil {
+			log.Error("Reconcile: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func reconcileOnce(c *Config, out io.Writer) error {
+	store, err := state.NewStore(c.StateDir)
+	if err != nil {
+		return err
+	}
+	endpoints, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	manager, err := newNetworkManager(c)
+	if err != nil {
+		return err
+	}
+	agent := vrouter.NewPortClient(c.AgentServer, c.AgentPort)
+	ports, err := agent.ListPorts()
+	if err != nil {
+		return err
+	}
+	portMap := make(map[string]bool)
+	for _, port := range ports {
+		portMap[port.Id] = true
+	}
+
+	failed := 0
+	for _, listed := range endpoints {
+		// Reconcile the current record, which a start or stop may have
+		// changed since the list.
+		err := store.Update(listed.Id, func(endpoint *state.Endpoint) error {
+			if endpoint.Stage != state.StageComplete {
+				return nil
+			}
+			repaired, err := reconcileEndpoint(c, manager, agent, portMap, endpoint)
+			for _, item := range repaired {
+				fmt.Fprintf(out, "%s: repaired %s\n", endpoint.Id, item)
+			}
+			return err
+		})
+		if err != nil && err != state.ErrNotFound {
+			log.Error("Reconcile %s: %v", listed.Id, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d containers could not be reconciled", failed, len(endpoints))
+	}
+	return nil
+}
+
+func reconcileEndpoint(c *Config, manager network.NetworkManager, agent vrouter.PortClient,
+	ports map[string]bool, endpoint *state.Endpoint) ([]string, error) {
+	resolver, err := network.NewNamespaceResolver(endpoint.NetnsType, c.DockerSocket, c.ContainerdNs)
+	if err != nil {
+		return nil, err
+	}
+	nsPath, err := resolver.Resolve(endpoint.Netns)
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate network namespace %s: %v", endpoint.Netns, err)
+	}
+
+	var repaired []string
+	for i, ifc := range endpoint.Interfaces {
+		items, err := reconcileInterface(manager, agent, ports, endpoint, nsPath, i, ifc)
+		repaired = append(repaired, items...)
+		if err != nil {
+			return repaired, err
+		}
+	}
+
+	if endpoint.SecurityGroups != nil {
+		client, err := newApiClient(c)
+		if err != nil {
+			return repaired, err
+		}
+		groups := network.NewSecurityGroupManager(client)
+		for i := range endpoint.Interfaces {
+			nicName := network.InterfaceName(endpoint.Id, i)
+			changed, err := groups.SetInterfaceSecurityGroups(endpoint.Tenant, nicName, endpoint.SecurityGroups)
+			if err != nil {
+				return repaired, err
+			}
+			if changed {
+				repaired = append(repaired, "security groups of "+nicName)
+			}
+		}
+	}
+	return repaired, nil
+}
+
+func reconcileInterface(manager network.NetworkManager, agent vrouter.PortClient, ports map[string]bool,
+	endpoint *state.Endpoint, nsPath string, index int, ifc *state.Interface) ([]string, error) {
+	metadata := &ifc.Metadata
+	repaired, err := manager.Repair(endpoint.Tenant, ifc.Network, endpoint.Id, index, metadata, ifc.FloatingIpPool, ifc.FloatingIp)
+	if err != nil {
+		return repaired, err
+	}
+
+	nsMan := network.NewNetnsManager()
+	portStale := false
+	err = nsMan.CheckInterface(endpoint.Id, nsPath, ifc.Config(index))
+	if err != nil {
+		log.Info("Interface %s of %s: %v", ifc.Name, endpoint.Id, err)
+		if err := nsMan.DeleteInterface(endpoint.Id, index); err != nil {
+			return repaired, err
+		}
+		masterName, err := nsMan.CreateInterface(endpoint.Id, nsPath, ifc.Config(index))
+		if err != nil {
+			return repaired, err
+		}
+		ifc.VethName = masterName
+		repaired = append(repaired, "veth "+masterName)
+		portStale = true
+	}
+
+	if !ports[metadata.NicId] || portStale {
+		if err := agent.AddPort(vrouterPort(endpoint.Id, ifc)); err != nil {
+			return repaired, err
+		}
+		repaired = append(repaired, "vrouter port "+metadata.NicId)
+	}
+	return repaired, nil
+}
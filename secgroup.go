@@ -0,0 +1,97 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/pedro-r-marques/packnet/pkg/network"
+	"github.com/pedro-r-marques/packnet/pkg/state"
+)
+
+// defineSecurityGroups creates or updates the security groups of the
+// --security-group-file in the tenant project.
+func defineSecurityGroups(c *Config, manager network.SecurityGroupManager, tenant string) error {
+	if c.SecurityGroupFile == "" {
+		return nil
+	}
+	var file network.SecurityGroupFile
+	if err := network.LoadSpec(c.SecurityGroupFile, &file); err != nil {
+		return err
+	}
+	for i := range file.SecurityGroups {
+		if _, err := manager.LocateSecurityGroup(tenant, &file.SecurityGroups[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applySecurityGroups defines the security groups of the configuration and,
+// unless groups is nil, replaces the groups of the interfaces of the endpoint
+// with groups and records them. An empty groups removes them all.
+func applySecurityGroups(c *Config, endpoint *state.Endpoint, groups []string) error {
+	client, err := newApiClient(c)
+	if err != nil {
+		return err
+	}
+	manager := network.NewSecurityGroupManager(client)
+	if err := defineSecurityGroups(c, manager, endpoint.Tenant); err != nil {
+		return err
+	}
+	if groups == nil {
+		return nil
+	}
+	for i := range endpoint.Interfaces {
+		nicName := network.InterfaceName(endpoint.Id, i)
+		if _, err := manager.SetInterfaceSecurityGroups(endpoint.Tenant, nicName, groups); err != nil {
+			return err
+		}
+	}
+	endpoint.SecurityGroups = groups
+	return nil
+}
+
+// SecurityGroups defines the security groups of --security-group-file and, for
+// a connected container, replaces the security groups of its interfaces with
+// those given by --security-group, or removes them all when clear is set.
+func SecurityGroups(c *Config, containerId string, clear bool) error {
+	if containerId == "" {
+		client, err := newApiClient(c)
+		if err != nil {
+			return err
+		}
+		return defineSecurityGroups(c, network.NewSecurityGroupManager(client), c.Tenant)
+	}
+	groups := c.SecurityGroups
+	if clear {
+		groups = []string{}
+	} else if len(groups) == 0 {
+		return fmt.Errorf("no security groups given for %s", containerId)
+	}
+	store, err := state.NewStore(c.StateDir)
+	if err != nil {
+		return err
+	}
+	err = store.Update(containerId, func(endpoint *state.Endpoint) error {
+		return applySecurityGroups(c, endpoint, groups)
+	})
+	if err == state.ErrNotFound {
+		return &NotConnectedError{Id: containerId}
+	}
+	return err
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2015 Juniper Networks, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pedro-r-marques/packnet/pkg/network"
+	"github.com/pedro-r-marques/packnet/pkg/state"
+	"github.com/pedro-r-marques/packnet/pkg/vrouter"
+)
+
+// loadEndpoint returns the local record of a connected container.
+func loadEndpoint(c *Config, containerId string) (*state.Endpoint, error) {
+	store, err := state.NewStore(c.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := store.Get(containerId)
+	if err == state.ErrNotFound {
+		return nil, &NotConnectedError{Id: containerId}
+	}
+	return endpoint, err
+}
+
+// interfaceAddresses returns the addresses of an interface, floating address
+// included, as a comma separated list.
+func interfaceAddresses(ifc *state.Interface) string {
+	var addresses []string
+	for _, address := range []string{ifc.Metadata.IpAddress, ifc.Metadata.IpAddress6, ifc.FloatingIp} {
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return strings.Join(addresses, ",")
+}
+
+// statusReport prints one line per checked item and counts the problems.
+type statusReport struct {
+	out      io.Writer
+	problems int
+}
+
+func (r *statusReport) check(item string, err error) {
+	if err != nil {
+		r.problems++
+		fmt.Fprintf(r.out, "  %-28s %v\n", item, err)
+		return
+	}
+	fmt.Fprintf(r.out, "  %-28s ok\n", item)
+}
+
+// compareMetadata reports the first difference between the recorded
+// metadata of an interface and the OpenContrail configuration.
+func compareMetadata(recorded, current *network.InstanceMetadata) error {
+	fields := []struct{ name, recorded, current string }{
+		{"virtual-machine", recorded.InstanceId, current.InstanceId},
+		{"interface", recorded.NicId, current.NicId},
+		{"mac address", recorded.MacAddress, current.MacAddress},
+		{"address", recorded.IpAddress, current.IpAddress},
+		{"IPv6 address", recorded.IpAddress6, current.IpAddress6},
+	}
+	for _, field := range fields {
+		if field.recorded != field.current {
+			return fmt.Errorf("%s is %q instead of %q", field.name, field.current, field.recorded)
+		}
+	}
+	return nil
+}
+
+// Status checks the OpenContrail objects, the vrouter port and the namespace
+// configuration of each interface of a connected container. It returns
+// ErrDegraded when any of them is missing or differs from the local record.
+func Status(c *Config, containerId string, out io.Writer) error {
+	endpoint, err := loadEndpoint(c, containerId)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "container %s: tenant %s, stage %s, netns %s %s, updated %s\n",
+		endpoint.Id, endpoint.Tenant, endpoint.Stage, endpoint.NetnsType, endpoint.Netns,
+		endpoint.Updated.Format(time.RFC3339))
+	if len(endpoint.SecurityGroups) > 0 {
+		fmt.Fprintf(out, "security groups: %s\n", strings.Join(endpoint.SecurityGroups, ","))
+	}
+
+	report := &statusReport{out: out}
+	if endpoint.Stage != state.StageComplete {
+		report.check("provisioning", fmt.Errorf("interrupted at stage %s", endpoint.Stage))
+	}
+	manager, err := newNetworkManager(c)
+	if err != nil {
+		return err
+	}
+	agent := vrouter.NewPortClient(c.AgentServer, c.AgentPort)
+	ports := make(map[string]bool)
+	portList, portErr := agent.ListPorts()
+	for _, port := range portList {
+		ports[port.Id] = true
+	}
+	nsPath := ""
+	resolver, nsErr := network.NewNamespaceResolver(endpoint.NetnsType, c.DockerSocket, c.ContainerdNs)
+	if nsErr == nil {
+		nsPath, nsErr = resolver.Resolve(endpoint.Netns)
+	}
+	nsMan := network.NewNetnsManager()
+
+	for i, ifc := range endpoint.Interfaces {
+		route := ""
+		if ifc.DefaultRoute {
+			route = ", default route"
+		}
+		fmt.Fprintf(out, "%s: network %s, veth %s, mac %s, address %s%s\n",
+			ifc.Name, ifc.Network, ifc.VethName, ifc.Metadata.MacAddress, interfaceAddresses(ifc), route)
+
+		current, err := manager.LookupInterface(endpoint.Tenant, ifc.Network, endpoint.Id, i)
+		if err == nil {
+			err = compareMetadata(&ifc.Metadata, current)
+		}
+		report.check("opencontrail objects", err)
+
+		err = portErr
+		if err == nil && !ports[ifc.Metadata.NicId] {
+			err = fmt.Errorf("port %s is missing", ifc.Metadata.NicId)
+		}
+		report.check("vrouter port", err)
+
+		err = nsErr
+		if err == nil {
+			err = nsMan.CheckInterface(endpoint.Id, nsPath, ifc.Config(i))
+		}
+		report.check("namespace configuration", err)
+	}
+
+	if report.problems > 0 {
+		return ErrDegraded
+	}
+	return nil
+}
+
+// List prints the containers connected on this host.
+func List(c *Config, out io.Writer) error {
+	store, err := state.NewStore(c.StateDir)
+	if err != nil {
+		return err
+	}
+	endpoints, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "CONTAINER\tTENANT\tNETWORKS\tADDRESSES\tSTAGE\tUPDATED\n")
+	for _, endpoint := range endpoints {
+		var networks, addresses []string
+		for _, ifc := range endpoint.Interfaces {
+			networks = append(networks, ifc.Network)
+			addresses = append(addresses, interfaceAddresses(ifc))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", endpoint.Id, endpoint.Tenant,
+			strings.Join(networks, ","), strings.Join(addresses, ";"), endpoint.Stage,
+			endpoint.Updated.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// Inspect prints the local record of a connected container, including the
+// instance metadata of each interface, as JSON.
+func Inspect(c *Config, containerId string, out io.Writer) error {
+	endpoint, err := loadEndpoint(c, containerId)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(endpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}